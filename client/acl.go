@@ -0,0 +1,30 @@
+package client
+
+import (
+	"net"
+
+	"github.com/jinliming2/secure-dns/config"
+)
+
+type accessControl struct {
+	allow config.CIDRList
+	deny  config.CIDRList
+}
+
+// allowed reports whether ip is not denied, and is allowed if allow list is not empty
+func (acl *accessControl) allowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	if acl.deny.Contains(ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || acl.allow.Contains(ip)
+}
+
+func newAccessControl(allow, deny config.CIDRList) *accessControl {
+	if len(allow)+len(deny) == 0 {
+		return nil
+	}
+	return &accessControl{allow: allow, deny: deny}
+}
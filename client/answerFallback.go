@@ -0,0 +1,68 @@
+package client
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/jinliming2/secure-dns/config"
+	"github.com/jinliming2/secure-dns/selector"
+	"github.com/miekg/dns"
+)
+
+// answerFallback resends queries to another upstream if addresses in answer are not expected
+type answerFallback struct {
+	upstream selector.Selector
+
+	mu       sync.RWMutex
+	expectIP config.CIDRList
+	bogusIP  config.CIDRList
+}
+
+// needed reports whether any A or AAAA record in response is not in expected networks or is in bogus networks
+func (fallback *answerFallback) needed(response *dns.Msg) bool {
+	fallback.mu.RLock()
+	defer fallback.mu.RUnlock()
+
+	for _, answer := range response.Answer {
+		ip := answerIP(answer)
+		if ip == nil {
+			continue
+		}
+		if len(fallback.expectIP) > 0 && !fallback.expectIP.Contains(ip) {
+			return true
+		}
+		if fallback.bogusIP.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fallback *answerFallback) setExpectIP(expectIP config.CIDRList) {
+	fallback.mu.Lock()
+	defer fallback.mu.Unlock()
+	fallback.expectIP = expectIP
+}
+
+// readCIDRList reads ip addresses or networks from file, each line contains one, lines starting with # are ignored
+func readCIDRList(fileName string) (config.CIDRList, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	list := make(config.CIDRList, 0, len(lines))
+	for _, line := range lines {
+		trimLine := strings.TrimSpace(line)
+		if trimLine == "" || strings.HasPrefix(trimLine, "#") {
+			continue
+		}
+		var cidr config.CIDR
+		if err := cidr.UnmarshalText([]byte(trimLine)); err != nil {
+			return nil, err
+		}
+		list = append(list, cidr)
+	}
+	return list, nil
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// filterAnswer rewrites response to NXDOMAIN if it contains any address in bogus_nxdomain,
+// and removes A and AAAA records with address in block_answer_ip
+func (client *Client) filterAnswer(response *dns.Msg) {
+	if response.Rcode != dns.RcodeSuccess || len(client.bogusNXDomain)+len(client.blockAnswerIP) == 0 {
+		return
+	}
+
+	for _, answer := range response.Answer {
+		if ip := answerIP(answer); ip != nil && client.bogusNXDomain.Contains(ip) {
+			client.logger.Debugf("[%d] bogus answer %s, rewriting to NXDOMAIN", response.Id, ip.String())
+			setNXDomain(response)
+			return
+		}
+	}
+
+	removeAnswers(response, func(name string, ip net.IP) bool {
+		if client.blockAnswerIP.Contains(ip) {
+			client.logger.Debugf("[%d] removed blocked answer %s", response.Id, ip.String())
+			return true
+		}
+		return false
+	})
+}
+
+// removeAnswers removes A and AAAA records if remove returns true for their owner names and addresses,
+// response is rewritten to NXDOMAIN if all address records are removed
+func removeAnswers(response *dns.Msg, remove func(name string, ip net.IP) bool) {
+	answers := response.Answer[:0]
+	hasAddress, removed := false, false
+	for _, answer := range response.Answer {
+		ip := answerIP(answer)
+		if ip == nil {
+			answers = append(answers, answer)
+			continue
+		}
+		if remove(answer.Header().Name, ip) {
+			removed = true
+			continue
+		}
+		hasAddress = true
+		answers = append(answers, answer)
+	}
+	response.Answer = answers
+
+	if removed && !hasAddress {
+		setNXDomain(response)
+	}
+}
+
+// setNXDomain clears all records except OPT in response, and sets rcode to NXDOMAIN
+func setNXDomain(response *dns.Msg) {
+	response.Rcode = dns.RcodeNameError
+	response.Answer = nil
+	response.Ns = nil
+	extra := response.Extra[:0]
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	response.Extra = extra
+}
+
+// answerIP returns address of A or AAAA record, or nil for other records
+func answerIP(rr dns.RR) net.IP {
+	switch record := rr.(type) {
+	case *dns.A:
+		return record.A
+	case *dns.AAAA:
+		return record.AAAA
+	default:
+		return nil
+	}
+}
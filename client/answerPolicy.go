@@ -0,0 +1,15 @@
+package client
+
+// answerPolicy controls answers of a query, options of [config] are overridden by client group and then the matched rule
+type answerPolicy struct {
+	ipv6 ipv6Policy
+	svcb svcbPolicy
+}
+
+// policy returns answer policy of group, or global policy if group is nil
+func (client *Client) policy(group *clientGroup) answerPolicy {
+	if group != nil {
+		return answerPolicy{ipv6: group.ipv6, svcb: group.svcb}
+	}
+	return answerPolicy{ipv6: client.ipv6, svcb: client.svcb}
+}
@@ -108,6 +108,14 @@ func (cache *Cache) clean() {
 	}
 }
 
+// Clear all items in cache
+func (cache *Cache) Clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.caches = make(map[string]map[uint16]map[uint16]*cacheItem)
+}
+
 // Destroy caches, stop cleaning tick
 func (cache *Cache) Destroy() {
 	close(cache.done)
@@ -2,10 +2,14 @@ package client
 
 import (
 	"context"
-	"net"
 	"time"
 
 	"github.com/jinliming2/secure-dns/client/cache"
+	"github.com/jinliming2/secure-dns/client/matcher"
+	"github.com/jinliming2/secure-dns/client/ratelimit"
+	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/jinliming2/secure-dns/client/watcher"
+	"github.com/jinliming2/secure-dns/config"
 	"github.com/jinliming2/secure-dns/selector"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -16,15 +20,43 @@ type Client struct {
 	logger  *zap.SugaredLogger
 	timeout time.Duration
 
-	bootstrap *net.Resolver
+	bootstrap *resolver.Bootstrap
 	upstream  selector.Selector
+	pools     map[string]selector.Selector
 
-	custom []*customResolver
+	groups []*clientGroup
+
+	answerFallback *answerFallback
+	bogusNXDomain  config.CIDRList
+	blockAnswerIP  config.CIDRList
+	rebind         *rebindProtection
+	dns64          *dns64
+	ipv6           ipv6Policy
+	svcb           svcbPolicy
+
+	acl         *accessControl
+	listenerACL map[string]*accessControl
+	denyAction  string
+
+	limiter       *ratelimit.Limiter
+	rateLimitSlip uint32
+
+	custom        []*customResolver
+	customMatcher *matcher.Matcher
+
+	rewrites       []*rewriteRule
+	rewriteMatcher *matcher.Matcher
+
+	zones       []*resolver.ZoneDNSClient
+	zoneMatcher *matcher.Matcher
+
+	watcher *watcher.Watcher
 
 	servers []*dns.Server
 
 	cacher        *cache.Cache
 	cacheNoAnswer uint32
+	hostsTTL      uint32
 }
 
 func startDNSServer(server *dns.Server, logger *zap.SugaredLogger, results chan error) {
@@ -44,16 +76,17 @@ func (client *Client) ListenAndServe(addr []string) error {
 	client.logger.Info("creating server...")
 	for _, address := range addr {
 		client.logger.Debugf("new server: %s", address)
+		acl := client.listenerACL[address]
 		udpServer := &dns.Server{
 			Addr:    address,
 			Net:     "udp",
-			Handler: dns.HandlerFunc(client.udpHandlerFunc),
+			Handler: client.newHandler(false, acl),
 			UDPSize: dns.DefaultMsgSize,
 		}
 		tcpServer := &dns.Server{
 			Addr:    address,
 			Net:     "tcp",
-			Handler: dns.HandlerFunc(client.tcpHandlerFunc),
+			Handler: client.newHandler(true, acl),
 		}
 		go startDNSServer(udpServer, client.logger, results)
 		go startDNSServer(tcpServer, client.logger, results)
@@ -87,8 +120,17 @@ func (client *Client) ShutdownContext(ctx context.Context) (errors []error) {
 			}
 		}
 	}
+	if client.watcher != nil {
+		if err := client.watcher.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if client.limiter != nil {
+		client.limiter.Destroy()
+	}
 	if client.cacher != nil {
 		client.cacher.Destroy()
 	}
+	client.bootstrap.Destroy()
 	return
 }
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/jinliming2/secure-dns/config"
+)
+
+// loadClientCertificate loads client certificate of TLS settings, or returns nil if not specified.
+// The certificate is reloaded after the certificate file or the key file changed
+func (client *Client) loadClientCertificate(conf *config.Config, settings config.TLSSettings) (*resolver.ClientCertificate, error) {
+	if settings.ClientCert == "" && settings.ClientKey == "" {
+		return nil, nil
+	}
+	if settings.ClientCert == "" || settings.ClientKey == "" {
+		return nil, errors.New("client_cert and client_key should be specified together")
+	}
+
+	cert, err := resolver.NewClientCertificate(conf.Path(settings.ClientCert), conf.Path(settings.ClientKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if client.watcher == nil {
+		return cert, nil
+	}
+	certFile, keyFile := cert.Files()
+	reload := func() {
+		if err := cert.Reload(); err != nil {
+			client.logger.Warnf("failed to reload client certificate %s: %s", certFile, err.Error())
+			return
+		}
+		client.logger.Infof("reloaded client certificate %s", certFile)
+	}
+	if err = client.watcher.Add(certFile, reload); err != nil {
+		return nil, err
+	}
+	if keyFile != certFile {
+		if err = client.watcher.Add(keyFile, reload); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
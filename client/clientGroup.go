@@ -0,0 +1,59 @@
+package client
+
+import (
+	"net"
+
+	"github.com/jinliming2/secure-dns/config"
+	"github.com/jinliming2/secure-dns/selector"
+)
+
+type clientGroup struct {
+	name          string
+	cidr          config.CIDRList
+	upstreamTag   string
+	upstream      selector.Selector // nil to use default upstream
+	customECS     []net.IP
+	noECS         bool
+	noCache       bool
+	cacheNoAnswer uint32
+	dns64         *dns64 // nil to disable DNS64
+	ipv6          ipv6Policy
+	svcb          svcbPolicy
+}
+
+// matchClientGroup returns the first client group that contains addr, or nil if no one matched
+func (client *Client) matchClientGroup(addr net.Addr) *clientGroup {
+	if len(client.groups) == 0 {
+		return nil
+	}
+	ip := remoteIP(addr)
+	if ip == nil {
+		return nil
+	}
+	for _, group := range client.groups {
+		if group.cidr.Contains(ip) {
+			return group
+		}
+	}
+	return nil
+}
+
+func (client *Client) hasClientGroup(name string) bool {
+	for _, group := range client.groups {
+		if group.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
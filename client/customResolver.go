@@ -1,46 +1,117 @@
 package client
 
 import (
+	"fmt"
+	"io/ioutil"
+	"sort"
 	"strings"
 
+	"github.com/jinliming2/secure-dns/client/matcher"
 	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/jinliming2/secure-dns/config"
 )
 
 type customResolver struct {
-	matcher  func(string) bool
-	resolver resolver.DNSClient
+	index        int
+	priority     int32
+	condition    string
+	resolver     resolver.DNSClient
+	disableAAAA  *bool // nil to use policy of client group or global
+	preferIPv4   *bool
+	svcbPolicy   *string
+	svcbStripECH *bool
 }
 
-func newCustomResolver(resolver resolver.DNSClient, domain, suffix []string) *customResolver {
-	domainList := make([]string, len(domain))
-	for index, d := range domain {
-		domainList[index] = strings.Trim(d, ".")
+// addCustomResolver adds a resolver which is used for domain names matched by rule
+func (client *Client) addCustomResolver(resolver resolver.DNSClient, rule matcher.Rule) (*customResolver, error) {
+	for _, group := range rule.ClientGroup {
+		if !client.hasClientGroup(group) {
+			return nil, fmt.Errorf("no such client group: %s", group)
+		}
 	}
+	cr := &customResolver{
+		index:     len(client.custom),
+		priority:  rule.Priority,
+		condition: rule.String(),
+		resolver:  resolver,
+	}
+	if err := client.customMatcher.Set(cr.index, rule); err != nil {
+		return nil, err
+	}
+	client.custom = append(client.custom, cr)
+	return cr, nil
+}
 
-	suffixList := make([]string, len(suffix))
-	for index, s := range suffix {
-		suffixList[index] = "." + strings.Trim(s, ".")
+// addCustomResolverWithPolicy adds a resolver which is used for domain names matched by rule,
+// answers of it are filtered with policy instead of the policy of client group or global if specified
+func (client *Client) addCustomResolverWithPolicy(resolver resolver.DNSClient, rule matcher.Rule, policy config.AnswerPolicy) (*customResolver, error) {
+	cr, err := client.addCustomResolver(resolver, rule)
+	if err != nil {
+		return nil, err
 	}
+	cr.disableAAAA, cr.preferIPv4 = policy.DisableAAAA, policy.PreferIPv4
+	cr.svcbPolicy, cr.svcbStripECH = policy.SVCBPolicy, policy.SVCBStripECH
+	return cr, nil
+}
 
-	return &customResolver{
-		matcher: func(domain string) bool {
-			trimmedDomain := strings.Trim(domain, ".")
+// updateCustomResolver replaces matching rule of cr
+func (client *Client) updateCustomResolver(cr *customResolver, rule matcher.Rule) error {
+	return client.customMatcher.Set(cr.index, rule)
+}
+
+// matchCustomResolver returns the best custom resolver that matches domain, qType and group, or nil if no one matched
+func (client *Client) matchCustomResolver(domain string, qType uint16, group *clientGroup) *customResolver {
+	groupName := ""
+	if group != nil {
+		groupName = group.name
+	}
+	if index := client.customMatcher.Match(domain, qType, groupName); index >= 0 {
+		return client.custom[index]
+	}
+	return nil
+}
 
-			for _, d := range domainList {
-				if trimmedDomain == d {
-					return true
-				}
-			}
+// logRoutingTable prints custom resolvers sorted by priority
+func (client *Client) logRoutingTable() {
+	table := make([]*customResolver, len(client.custom))
+	copy(table, client.custom)
+	sort.SliceStable(table, func(i, j int) bool { return table[i].priority > table[j].priority })
 
-			trimmedDomain = "." + trimmedDomain
-			for _, s := range suffixList {
-				if strings.HasSuffix(trimmedDomain, s) {
-					return true
-				}
-			}
+	client.logger.Info("routing table (rules with the same priority are chosen by the most specific match):")
+	for _, rewrite := range client.rewrites {
+		client.logger.Infof("  [rewrite] %s => %s", rewrite.condition, rewrite.String())
+	}
+	for _, zone := range client.zones {
+		client.logger.Infof("  [zone] suffix [%s] => %s", strings.TrimSuffix(zone.Origin(), "."), zone.String())
+	}
+	for _, cr := range table {
+		client.logger.Infof("  [priority %d] %s => %s", cr.priority, cr.condition, cr.resolver.String())
+	}
+	for _, group := range client.groups {
+		if group.upstream != nil {
+			client.logger.Infof("  [default of client group %s] => %s (tag %s)", group.name, group.upstream.Name(), group.upstreamTag)
+		}
+	}
+	if client.upstream.Empty() {
+		client.logger.Info("  [default] no upstream")
+	} else {
+		client.logger.Infof("  [default] => %s", client.upstream.Name())
+	}
+}
 
-			return false
-		},
-		resolver: resolver,
+// readDomainList reads domains from file, each line contains a domain, lines starting with # are ignored
+func readDomainList(fileName string) ([]string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	domains := lines[:0]
+	for _, line := range lines {
+		trimLine := strings.TrimSpace(line)
+		if trimLine != "" && !strings.HasPrefix(trimLine, "#") {
+			domains = append(domains, trimLine)
+		}
 	}
+	return domains, nil
 }
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"net"
+
+	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/jinliming2/secure-dns/config"
+	"github.com/miekg/dns"
+)
+
+// dns64 synthesizes AAAA records from A records (RFC 6147)
+type dns64 struct {
+	prefix  config.CIDR
+	exclude config.CIDRList
+}
+
+func newDNS64(prefix config.CIDR, exclude config.CIDRList) *dns64 {
+	return &dns64{
+		prefix:  prefix,
+		exclude: exclude,
+	}
+}
+
+// synthesizeDNS64 returns response with AAAA records synthesized from A records of the query name,
+// if the query is AAAA and response has no AAAA record (except excluded ones)
+func (client *Client) synthesizeDNS64(d *dns64, r, response *dns.Msg, group *clientGroup, options resolver.ResolveOptions) *dns.Msg {
+	question := r.Question[0]
+	if d == nil || question.Qtype != dns.TypeAAAA || question.Qclass != dns.ClassINET || response.Rcode != dns.RcodeSuccess {
+		return response
+	}
+	for _, answer := range response.Answer {
+		// IPv4-mapped addresses are never treated as real AAAA answers (RFC 6147 section 5.1.4)
+		if aaaa, ok := answer.(*dns.AAAA); ok && aaaa.AAAA.To4() == nil && !d.exclude.Contains(aaaa.AAAA) {
+			return response
+		}
+	}
+
+	request := r.Copy()
+	request.Question[0].Qtype = dns.TypeA
+	aResponse, _, err := client.resolve(request, group, options)
+	if err != nil || aResponse.Rcode != dns.RcodeSuccess {
+		return response
+	}
+
+	// TTL of synthesized records should not be longer than negative caching TTL of the AAAA response
+	maxTTL := ^uint32(0)
+	for _, ns := range response.Ns {
+		if soa, ok := ns.(*dns.SOA); ok {
+			maxTTL = soa.Hdr.Ttl
+			if soa.Minttl < maxTTL {
+				maxTTL = soa.Minttl
+			}
+		}
+	}
+
+	answers := make([]dns.RR, 0, len(aResponse.Answer))
+	synthesized := false
+	for _, answer := range aResponse.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			if d.exclude.Contains(rr.A) {
+				continue
+			}
+			header := rr.Hdr
+			header.Rrtype = dns.TypeAAAA
+			if header.Ttl > maxTTL {
+				header.Ttl = maxTTL
+			}
+			answers = append(answers, &dns.AAAA{Hdr: header, AAAA: d.embed(rr.A)})
+			synthesized = true
+		case *dns.CNAME:
+			answers = append(answers, rr)
+		}
+	}
+	if !synthesized {
+		return response
+	}
+
+	client.logger.Debugf("[%d] synthesized AAAA records of %s with DNS64 prefix %s", r.Id, question.Name, d.prefix.String())
+	response.Answer = answers
+	response.Ns = nil
+	return response
+}
+
+// embed ip into prefix (RFC 6052 section 2.2), bits 64 to 71 are skipped
+func (d *dns64) embed(ip net.IP) net.IP {
+	ones, _ := d.prefix.Mask.Size()
+	result := make(net.IP, net.IPv6len)
+	copy(result, d.prefix.IP.To16())
+	ip4 := ip.To4()
+	for i, j := ones/8, 0; j < net.IPv4len; i++ {
+		if i == 8 {
+			continue
+		}
+		result[i] = ip4[j]
+		j++
+	}
+	return result
+}
@@ -10,6 +10,21 @@ import (
 
 var randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
 
+// RemoveECS removes all EDNS Client Subnet options of r, including the one with a source prefix-length of zero
+func RemoveECS(r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
 // SetECS set EDNS Client Subnet for specified DNS request Message
 func SetECS(r *dns.Msg, noECS bool, ecs []net.IP) {
 	opt := r.IsEdns0()
@@ -5,23 +5,50 @@ import (
 	"time"
 
 	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/jinliming2/secure-dns/config"
 	"github.com/miekg/dns"
 )
 
-func (client *Client) tcpHandlerFunc(w dns.ResponseWriter, r *dns.Msg) {
-	client.handlerFunc(w, r, true)
-}
-
-func (client *Client) udpHandlerFunc(w dns.ResponseWriter, r *dns.Msg) {
-	client.handlerFunc(w, r, false)
+func (client *Client) newHandler(useTCP bool, acl *accessControl) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		client.handlerFunc(w, r, useTCP, acl)
+	}
 }
 
-func (client *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, useTCP bool) {
+func (client *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, useTCP bool, acl *accessControl) {
 	if r.Response {
 		client.logger.Warn("received a response packet")
 		return
 	}
 
+	if client.acl != nil || acl != nil {
+		if ip := remoteIP(w.RemoteAddr()); !client.acl.allowed(ip) || !acl.allowed(ip) {
+			client.logger.Infof("[%d] denied request from %s", r.Id, w.RemoteAddr().String())
+			if client.denyAction == config.DenyActionDrop {
+				w.Close()
+			} else {
+				w.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeRefused))
+			}
+			return
+		}
+	}
+
+	if client.limiter != nil {
+		if allowed, limited := client.limiter.Allow(remoteIP(w.RemoteAddr())); !allowed {
+			if !useTCP && client.rateLimitSlip > 0 && limited%client.rateLimitSlip == 0 {
+				// slip: answer with TC bit, so that legitimate clients can retry with TCP
+				client.logger.Debugf("[%d] rate limited request from %s, slip", r.Id, w.RemoteAddr().String())
+				reply := new(dns.Msg).SetReply(r)
+				reply.Truncated = true
+				w.WriteMsg(reply)
+			} else {
+				client.logger.Debugf("[%d] rate limited request from %s, drop", r.Id, w.RemoteAddr().String())
+				w.Close()
+			}
+			return
+		}
+	}
+
 	if len(r.Question) != 1 {
 		client.logger.Warn("request packet contains more than 1 question is not allowed")
 		reply := new(dns.Msg).SetReply(r).SetRcodeFormatError(r)
@@ -46,10 +73,31 @@ func (client *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, useTCP bool)
 		qType = fmt.Sprintf("%d", question.Qtype)
 	}
 
-	client.logger.Infow(fmt.Sprintf("[%d] request", r.Id), "name", qName, "class", qClass, "type", qType)
+	group := client.matchClientGroup(w.RemoteAddr())
+
+	cacher := client.cacher
+	cacheKey := question.Name
+	cacheNoAnswer := client.cacheNoAnswer
+	dns64 := client.dns64
+	options := resolver.ResolveOptions{UseTCP: useTCP}
+
+	if group == nil {
+		client.logger.Infow(fmt.Sprintf("[%d] request", r.Id), "name", qName, "class", qClass, "type", qType)
+	} else {
+		client.logger.Infow(fmt.Sprintf("[%d] request", r.Id), "name", qName, "class", qClass, "type", qType, "group", group.name)
+		if group.noCache {
+			cacher = nil
+		}
+		cacheKey += "#" + group.name
+		cacheNoAnswer = group.cacheNoAnswer
+		options.ForceNoECS = group.noECS
+		options.CustomECS = group.customECS
+		options.ClientGroup = group.name
+		dns64 = group.dns64
+	}
 
-	if client.cacher != nil {
-		if cached, delta := client.cacher.Get(question.Name, question.Qtype, question.Qclass); cached != nil {
+	if cacher != nil {
+		if cached, delta := cacher.Get(cacheKey, question.Qtype, question.Qclass); cached != nil {
 			response := cached.(*dns.Msg).Copy()
 			response.Id = r.Id
 			if delta > 0 {
@@ -69,45 +117,18 @@ func (client *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, useTCP bool)
 		}
 	}
 
-	var c *resolver.DNSClient
-
-	for _, custom := range client.custom {
-		if custom.matcher(qName) {
-			c = &custom.resolver
-			client.logger.Debugf("[%d] using %s for %s [condition]", r.Id, (*c).String(), qName)
-			break
-		}
-	}
-
-	if c == nil {
-		if client.upstream.Empty() {
-			client.logger.Warnf("no upstream to use for querying %s", qName)
-			reply := new(dns.Msg).SetRcode(r, dns.RcodeServerFailure)
-			w.WriteMsg(reply)
-			return
-		}
-
-		c = client.upstream.Get().Client
-		client.logger.Debugf("[%d] using %s for %s", r.Id, (*c).String(), qName)
-	}
-
-	response, err := (*c).Resolve(r, useTCP, false)
-	if err != nil {
-		client.logger.Warn(err.Error())
-	}
-	if (len(response.Answer) == 0 || !answerHasType(response.Answer, question.Qtype)) && (!(*c).ECSDisabled()) && (*c).FallbackNoECSEnabled() {
-		client.logger.Debugf("[%d] retring resolve %s with ECS disabled", r.Id, qName)
-		response, err = (*c).Resolve(r, useTCP, true)
-		if err != nil {
-			client.logger.Warn(err.Error())
-		}
+	response, policy, err := client.resolve(r, group, options)
+	if err == nil && !policy.ipv6.disableAAAA {
+		response = client.synthesizeDNS64(dns64, r, response, group, options)
 	}
+	client.filterSVCB(response, group, policy.svcb)
+	client.filterAnswer(response)
 	w.WriteMsg(response)
 
-	if client.cacher != nil && err == nil {
+	if cacher != nil && err == nil {
 		var minttl uint32
 		if response.Rcode == dns.RcodeNameError || len(response.Answer)+len(response.Ns)+len(response.Extra) == 0 {
-			minttl = client.cacheNoAnswer
+			minttl = cacheNoAnswer
 		} else if response.Rcode == dns.RcodeSuccess {
 			for _, answer := range response.Answer {
 				ttl := answer.Header().Ttl
@@ -129,9 +150,113 @@ func (client *Client) handlerFunc(w dns.ResponseWriter, r *dns.Msg, useTCP bool)
 			}
 		}
 		if minttl > 0 {
-			client.cacher.SetDataTTL(question.Name, question.Qtype, question.Qclass, response, time.Duration(minttl)*time.Second)
+			cacher.SetDataTTL(cacheKey, question.Qtype, question.Qclass, response, time.Duration(minttl)*time.Second)
+		}
+	}
+}
+
+// resolve r with rewrite rules, zones, custom resolvers or upstream of group,
+// returns policy of the answer as well
+func (client *Client) resolve(r *dns.Msg, group *clientGroup, options resolver.ResolveOptions) (*dns.Msg, answerPolicy, error) {
+	return client.resolveRewrite(r, group, options, maxRewriteDepth)
+}
+
+// resolveUpstreamHost resolves host names of upstream DNS servers through client itself, instead of bootstrap DNS servers
+func (client *Client) resolveUpstreamHost(r *dns.Msg) (*dns.Msg, error) {
+	response, _, err := client.resolve(r, nil, resolver.ResolveOptions{ForceNoECS: true})
+	return response, err
+}
+
+// route r to zones, custom resolvers or upstream of group, returns policy of the matched rule or group as well
+func (client *Client) route(r *dns.Msg, group *clientGroup, options resolver.ResolveOptions) (*dns.Msg, answerPolicy, error) {
+	question := &r.Question[0]
+	qName := question.Name
+
+	var c *resolver.DNSClient
+
+	policy := client.policy(group)
+
+	if zone := client.matchZone(qName); zone != nil {
+		var zoneClient resolver.DNSClient = zone
+		c = &zoneClient
+		policy.ipv6 = ipv6Policy{}
+		client.logger.Debugf("[%d] using %s for %s [zone]", r.Id, (*c).String(), qName)
+	} else if custom := client.matchCustomResolver(qName, question.Qtype, group); custom != nil {
+		c = &custom.resolver
+		policy.ipv6 = policy.ipv6.override(custom.disableAAAA, custom.preferIPv4)
+		policy.svcb = policy.svcb.override(custom.svcbPolicy, custom.svcbStripECH)
+		client.logger.Debugf("[%d] using %s for %s [condition]", r.Id, (*c).String(), qName)
+	}
+
+	if policy.ipv6.disableAAAA && question.Qtype == dns.TypeAAAA {
+		client.logger.Debugf("[%d] AAAA disabled for %s", r.Id, qName)
+		response := new(dns.Msg).SetReply(r)
+		resolver.SetNegativeAnswer(response, dns.RcodeSuccess, client.hostsTTL)
+		return response, policy, nil
+	}
+
+	fromUpstream := c == nil
+	if fromUpstream {
+		upstream := client.upstream
+		if group != nil && group.upstream != nil {
+			upstream = group.upstream
+		}
+		if upstream.Empty() {
+			client.logger.Warnf("no upstream to use for querying %s", qName)
+			return new(dns.Msg).SetRcode(r, dns.RcodeServerFailure), policy, fmt.Errorf("no upstream to use for querying %s", qName)
+		}
+
+		c = upstream.Get().Client
+		client.logger.Debugf("[%d] using %s for %s", r.Id, (*c).String(), qName)
+	}
+
+	response, err := (*c).Resolve(r, options)
+	if err != nil {
+		client.logger.Warn(err.Error())
+	}
+	if (len(response.Answer) == 0 || !answerHasType(response.Answer, question.Qtype)) && !options.ForceNoECS && (!(*c).ECSDisabled()) && (*c).FallbackNoECSEnabled() {
+		client.logger.Debugf("[%d] retring resolve %s with ECS disabled", r.Id, qName)
+		options.ForceNoECS = true
+		response, err = (*c).Resolve(r, options)
+		if err != nil {
+			client.logger.Warn(err.Error())
+		}
+	}
+
+	if fromUpstream && err == nil && client.answerFallback != nil && client.answerFallback.needed(response) {
+		fallback := client.answerFallback.upstream.Get().Client
+		client.logger.Debugf("[%d] unexpected answer of %s, retrying with %s", r.Id, qName, (*fallback).String())
+		// keep the original answer if the fallback fails
+		if fallbackResponse, fallbackErr := (*fallback).Resolve(r, options); fallbackErr != nil {
+			client.logger.Warnf("[%d] fallback of %s failed, using the original answer: %s", r.Id, qName, fallbackErr.Error())
+		} else if fallbackResponse.Rcode == dns.RcodeServerFailure {
+			client.logger.Warnf("[%d] fallback of %s failed with SERVFAIL, using the original answer", r.Id, qName)
+		} else {
+			c, response = fallback, fallbackResponse
 		}
 	}
+
+	if client.rebind != nil && err == nil && !isLocal(*c) {
+		if removed := client.rebind.filter(response); len(removed) > 0 {
+			client.logger.Warnf("[%d] removed private addresses %v of %s from %s", r.Id, removed, qName, (*c).String())
+		}
+	}
+
+	if policy.ipv6.preferIPv4 && err == nil && question.Qtype == dns.TypeAAAA && answerHasType(response.Answer, dns.TypeAAAA) {
+		client.preferIPv4(r, response, *c, options)
+	}
+
+	return response, policy, err
+}
+
+// isLocal reports whether c resolves with local records
+func isLocal(c resolver.DNSClient) bool {
+	switch c.(type) {
+	case *resolver.HostsDNSClient, *resolver.HostsFileDNSClient, *resolver.ZoneDNSClient:
+		return true
+	default:
+		return false
+	}
 }
 
 func answerHasType(answer []dns.RR, qType uint16) bool {
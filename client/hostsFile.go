@@ -0,0 +1,88 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/jinliming2/secure-dns/client/matcher"
+	"github.com/jinliming2/secure-dns/client/resolver"
+)
+
+// addHostsFile adds a resolver for domain names and addresses in hosts file
+func (client *Client) addHostsFile(fileName string, ttl uint32) error {
+	names, hosts, err := readHostsFile(fileName)
+	if err != nil {
+		return err
+	}
+	c := resolver.NewHostsFileDNSClient("HOSTS file "+fileName, ttl)
+	c.Set(names, hosts)
+	client.logger.Debugf("new HOSTS resolver: %d domain name(s) from file %s", len(names), fileName)
+
+	cr, err := client.addCustomResolver(c, hostsFileRule(c))
+	if err != nil {
+		return err
+	}
+
+	if client.watcher == nil {
+		return nil
+	}
+	return client.watcher.Add(fileName, func() {
+		names, hosts, err := readHostsFile(fileName)
+		if err != nil {
+			client.logger.Warnf("failed to reload %s: %s", fileName, err.Error())
+			return
+		}
+		c.Set(names, hosts)
+		if err := client.updateCustomResolver(cr, hostsFileRule(c)); err != nil {
+			client.logger.Warnf("failed to reload %s: %s", fileName, err.Error())
+			return
+		}
+		if client.cacher != nil {
+			client.cacher.Clear()
+		}
+		client.logger.Infof("reloaded %d domain name(s) from file %s", len(names), fileName)
+	})
+}
+
+// hostsFileRule matches domain names and reverse lookups of addresses in c
+func hostsFileRule(c *resolver.HostsFileDNSClient) matcher.Rule {
+	return matcher.Rule{Domain: append(append([]string{}, c.Names()...), c.ReverseNames()...)}
+}
+
+// readHostsFile reads /etc/hosts format file, each line contains an address followed by domain names,
+// characters after # are ignored. Domain names are returned in the order of their first appearance
+func readHostsFile(fileName string) ([]string, map[string][]net.IP, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	hosts := make(map[string][]net.IP)
+	for _, line := range strings.Split(string(data), "\n") {
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// strip zone index of link-local addresses, such as fe80::1%lo0
+		address := fields[0]
+		if zone := strings.IndexByte(address, '%'); zone >= 0 {
+			address = address[:zone]
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(name)
+			if _, ok := hosts[name]; !ok {
+				names = append(names, name)
+			}
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return names, hosts, nil
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/miekg/dns"
+)
+
+// ipv6Policy controls AAAA answers for networks without IPv6 routing
+type ipv6Policy struct {
+	// disableAAAA answers all AAAA queries with no record
+	disableAAAA bool
+	// preferIPv4 removes AAAA records if the domain name has A records
+	preferIPv4 bool
+}
+
+// override returns a copy of policy with specified options
+func (policy ipv6Policy) override(disableAAAA, preferIPv4 *bool) ipv6Policy {
+	if disableAAAA != nil {
+		policy.disableAAAA = *disableAAAA
+	}
+	if preferIPv4 != nil {
+		policy.preferIPv4 = *preferIPv4
+	}
+	return policy
+}
+
+// preferIPv4 removes AAAA records from response if c answers A records for the same domain name
+func (client *Client) preferIPv4(r, response *dns.Msg, c resolver.DNSClient, options resolver.ResolveOptions) {
+	request := r.Copy()
+	request.Question[0].Qtype = dns.TypeA
+	aResponse, err := c.Resolve(request, options)
+	if err != nil || !answerHasType(aResponse.Answer, dns.TypeA) {
+		return
+	}
+
+	answers := response.Answer[:0]
+	for _, answer := range response.Answer {
+		if answer.Header().Rrtype != dns.TypeAAAA {
+			answers = append(answers, answer)
+		}
+	}
+	response.Answer = answers
+	client.logger.Debugf("[%d] removed AAAA records of %s which has A records", r.Id, r.Question[0].Name)
+}
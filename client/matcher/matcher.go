@@ -0,0 +1,352 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Rule describes which domain names should be matched
+type Rule struct {
+	// Domain names to match exactly, glob patterns like api-*.example.com are allowed
+	Domain []string
+	// Suffix matches the domain name itself and all its subdomains
+	Suffix []string
+	// Regex matches domain names in lower case without the trailing dot
+	Regex []string
+	// Keyword matches domain names contain any of them
+	Keyword []string
+	// QType limits query types of this rule
+	QType []uint16
+	// ClientGroup limits client groups of this rule
+	ClientGroup []string
+	// Priority of this rule, rule with higher priority is preferred
+	Priority int32
+}
+
+func (r Rule) String() string {
+	conditions := make([]string, 0, 6)
+	for _, condition := range []struct {
+		name string
+		list []string
+	}{
+		{"domain", r.Domain},
+		{"suffix", r.Suffix},
+		{"regex", r.Regex},
+		{"keyword", r.Keyword},
+		{"qtype", qTypeNames(r.QType)},
+		{"client_group", r.ClientGroup},
+	} {
+		switch count := len(condition.list); {
+		case count == 0:
+		case count <= 3:
+			conditions = append(conditions, fmt.Sprintf("%s %v", condition.name, condition.list))
+		default:
+			conditions = append(conditions, fmt.Sprintf("%s %v... (%d in total)", condition.name, condition.list[:3], count))
+		}
+	}
+	return strings.Join(conditions, ", ")
+}
+
+func qTypeNames(qType []uint16) []string {
+	names := make([]string, len(qType))
+	for index, t := range qType {
+		if name, ok := dns.TypeToString[t]; ok {
+			names[index] = name
+		} else {
+			names[index] = fmt.Sprintf("TYPE%d", t)
+		}
+	}
+	return names
+}
+
+type rule struct {
+	index    int
+	priority int32
+	domain   []string
+	suffix   []string
+	glob     []*regexp.Regexp
+	regex    []*regexp.Regexp
+	keyword  []string
+	qType    []uint16
+	group    []string
+	matchAll bool // no domain condition specified, only query type or client group
+}
+
+// Matcher finds the best rule that matches a domain name.
+//
+// Rules with higher priority are preferred, then the more specific one:
+// exact domain > glob pattern > longer suffix > shorter suffix > regex, keyword and no domain condition.
+// Rules declared earlier (with smaller index) win the remaining ties.
+//
+// Each lookup of domain and suffix rules costs one hash lookup per label of the domain name,
+// regex, keyword and glob rules are checked one by one.
+type Matcher struct {
+	mu       sync.RWMutex
+	rules    map[int]*rule
+	exact    map[string][]int
+	suffix   map[string][]int
+	patterns []*rule // rules with regex, keyword, glob or no domain condition, sorted by priority
+}
+
+// NewMatcher returns an empty Matcher
+func NewMatcher() *Matcher {
+	return &Matcher{
+		rules:  make(map[int]*rule),
+		exact:  make(map[string][]int),
+		suffix: make(map[string][]int),
+	}
+}
+
+// Set rule of index, replacing the old one
+func (matcher *Matcher) Set(index int, r Rule) error {
+	newRule := &rule{
+		index:    index,
+		priority: r.Priority,
+		domain:   make([]string, 0, len(r.Domain)),
+		suffix:   normalizeList(r.Suffix),
+		regex:    make([]*regexp.Regexp, 0, len(r.Regex)),
+		keyword:  lowerList(r.Keyword),
+		qType:    r.QType,
+		group:    r.ClientGroup,
+	}
+
+	for _, d := range normalizeList(r.Domain) {
+		if strings.ContainsAny(d, "*?") {
+			newRule.glob = append(newRule.glob, compileGlob(d))
+		} else {
+			newRule.domain = append(newRule.domain, d)
+		}
+	}
+	for _, expr := range r.Regex {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		newRule.regex = append(newRule.regex, pattern)
+	}
+	newRule.matchAll = len(newRule.qType)+len(newRule.group) > 0 &&
+		len(newRule.domain)+len(newRule.suffix)+len(newRule.glob)+len(newRule.regex)+len(newRule.keyword) == 0
+
+	matcher.mu.Lock()
+	defer matcher.mu.Unlock()
+
+	if old, ok := matcher.rules[index]; ok {
+		for _, d := range old.domain {
+			matcher.remove(matcher.exact, d, index)
+		}
+		for _, s := range old.suffix {
+			matcher.remove(matcher.suffix, s, index)
+		}
+		if old.hasPattern() {
+			for i, p := range matcher.patterns {
+				if p == old {
+					matcher.patterns = append(matcher.patterns[:i], matcher.patterns[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	matcher.rules[index] = newRule
+	for _, d := range newRule.domain {
+		matcher.insert(matcher.exact, d, index)
+	}
+	for _, s := range newRule.suffix {
+		matcher.insert(matcher.suffix, s, index)
+	}
+	if newRule.hasPattern() {
+		i := sort.Search(len(matcher.patterns), func(i int) bool { return newRule.before(matcher.patterns[i]) })
+		matcher.patterns = append(matcher.patterns, nil)
+		copy(matcher.patterns[i+1:], matcher.patterns[i:])
+		matcher.patterns[i] = newRule
+	}
+
+	return nil
+}
+
+// Match returns index of the best rule matched domain, qType and group, or -1 if no rule matched
+func (matcher *Matcher) Match(domain string, qType uint16, group string) int {
+	name := normalize(domain)
+	labels := strings.Count(name, ".") + 1
+
+	matcher.mu.RLock()
+	defer matcher.mu.RUnlock()
+
+	var best *rule
+	bestSpecificity := 0
+
+	try := func(r *rule, specificity int) {
+		if best == nil || r.priority > best.priority ||
+			(r.priority == best.priority && (specificity > bestSpecificity ||
+				(specificity == bestSpecificity && r.index < best.index))) {
+			best = r
+			bestSpecificity = specificity
+		}
+	}
+
+	if r := matcher.first(matcher.exact[name], qType, group); r != nil {
+		try(r, 3*labels+2)
+	}
+
+	for suffix := name; ; labels-- {
+		if r := matcher.first(matcher.suffix[suffix], qType, group); r != nil {
+			try(r, 3*labels)
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 {
+			break
+		}
+		suffix = suffix[dot+1:]
+	}
+
+	for _, r := range matcher.patterns {
+		if best != nil && r.priority < best.priority {
+			break
+		}
+		if !r.accept(qType, group) {
+			continue
+		}
+		if specificity, ok := r.matchPattern(name); ok {
+			try(r, specificity)
+		}
+	}
+
+	if best == nil {
+		return -1
+	}
+	return best.index
+}
+
+// first returns the most preferred rule in indices which accepts qType and group
+func (matcher *Matcher) first(indices []int, qType uint16, group string) *rule {
+	for _, index := range indices {
+		if r := matcher.rules[index]; r.accept(qType, group) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *rule) hasPattern() bool {
+	return r.matchAll || len(r.glob)+len(r.regex)+len(r.keyword) > 0
+}
+
+func (r *rule) accept(qType uint16, group string) bool {
+	if len(r.qType) > 0 {
+		accepted := false
+		for _, t := range r.qType {
+			if t == qType {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return false
+		}
+	}
+	if len(r.group) > 0 {
+		for _, g := range r.group {
+			if g == group {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// before reports whether r should be preferred to other when they are equally specific
+func (r *rule) before(other *rule) bool {
+	return r.priority > other.priority || (r.priority == other.priority && r.index < other.index)
+}
+
+// matchPattern returns specificity of the most specific pattern matched name
+func (r *rule) matchPattern(name string) (int, bool) {
+	if r.matchAll {
+		return 0, true
+	}
+	for _, glob := range r.glob {
+		if glob.MatchString(name) {
+			return 3*(strings.Count(name, ".")+1) + 1, true
+		}
+	}
+	for _, keyword := range r.keyword {
+		if strings.Contains(name, keyword) {
+			return 0, true
+		}
+	}
+	for _, regex := range r.regex {
+		if regex.MatchString(name) {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// compileGlob converts glob pattern to regexp, * matches any characters in a label, ? matches one character
+func compileGlob(glob string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.ReplaceAll(expr, `\*`, `[^.]*`)
+	expr = strings.ReplaceAll(expr, `\?`, `[^.]`)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+func normalize(domain string) string {
+	return strings.ToLower(strings.Trim(domain, "."))
+}
+
+func normalizeList(list []string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if name := normalize(item); name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// lowerList converts items of list to lower case, keeping dots as they are written
+func lowerList(list []string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != "" {
+			result = append(result, strings.ToLower(item))
+		}
+	}
+	return result
+}
+
+// insert index into the index list of key, which is sorted by preference
+func (matcher *Matcher) insert(dict map[string][]int, key string, index int) {
+	indices := dict[key]
+	r := matcher.rules[index]
+	i := sort.Search(len(indices), func(i int) bool { return !matcher.rules[indices[i]].before(r) })
+	if i < len(indices) && indices[i] == index {
+		return
+	}
+	indices = append(indices, 0)
+	copy(indices[i+1:], indices[i:])
+	indices[i] = index
+	dict[key] = indices
+}
+
+// remove index from the index list of key
+func (matcher *Matcher) remove(dict map[string][]int, key string, index int) {
+	indices := dict[key]
+	for i, item := range indices {
+		if item != index {
+			continue
+		}
+		if len(indices) == 1 {
+			delete(dict, key)
+		} else {
+			dict[key] = append(indices[:i], indices[i+1:]...)
+		}
+		return
+	}
+}
@@ -0,0 +1,234 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []Rule
+		domain string
+		qType  uint16
+		group  string
+		want   int
+	}{
+		{
+			name:   "no rule",
+			domain: "example.com.",
+			want:   -1,
+		},
+		{
+			name:   "exact domain before glob and suffix",
+			rules:  []Rule{{Suffix: []string{"example.com"}}, {Domain: []string{"*.example.com"}}, {Domain: []string{"www.example.com"}}},
+			domain: "www.example.com.",
+			want:   2,
+		},
+		{
+			name:   "glob before suffix",
+			rules:  []Rule{{Suffix: []string{"example.com"}}, {Domain: []string{"*.example.com"}}, {Domain: []string{"www.example.com"}}},
+			domain: "api.example.com.",
+			want:   1,
+		},
+		{
+			name:   "glob matches only one label",
+			rules:  []Rule{{Suffix: []string{"example.com"}}, {Domain: []string{"*.example.com"}}},
+			domain: "a.b.example.com.",
+			want:   0,
+		},
+		{
+			name:   "suffix matches the domain itself",
+			rules:  []Rule{{Suffix: []string{"example.com"}}, {Domain: []string{"*.example.com"}}},
+			domain: "Example.COM.",
+			want:   0,
+		},
+		{
+			name:   "longer suffix before shorter suffix",
+			rules:  []Rule{{Suffix: []string{"com"}}, {Suffix: []string{"example.com"}}, {Suffix: []string{"b.example.com"}}},
+			domain: "a.b.example.com.",
+			want:   2,
+		},
+		{
+			name:   "suffix does not match partial label",
+			rules:  []Rule{{Suffix: []string{"example.com"}}},
+			domain: "notexample.com.",
+			want:   -1,
+		},
+		{
+			name:   "suffix before regex and keyword",
+			rules:  []Rule{{Regex: []string{`^www\.`}}, {Keyword: []string{"example"}}, {Suffix: []string{"com"}}},
+			domain: "www.example.com.",
+			want:   2,
+		},
+		{
+			name:   "earlier rule wins ties",
+			rules:  []Rule{{Keyword: []string{"example"}}, {Regex: []string{`^www\.`}}, {Suffix: []string{"example.com"}}, {Suffix: []string{"example.com"}}},
+			domain: "www.example.net.",
+			want:   0,
+		},
+		{
+			name:   "keyword keeps leading dot",
+			rules:  []Rule{{Keyword: []string{".CN"}}},
+			domain: "cnn.com.",
+			want:   -1,
+		},
+		{
+			name:   "keyword is case insensitive",
+			rules:  []Rule{{Keyword: []string{".CN"}}},
+			domain: "www.example.cn.",
+			want:   0,
+		},
+		{
+			name:   "keyword in the middle",
+			rules:  []Rule{{Keyword: []string{".CN"}}},
+			domain: "www.example.cn.net.",
+			want:   0,
+		},
+		{
+			name:   "priority before specificity",
+			rules:  []Rule{{Domain: []string{"www.example.com"}}, {Keyword: []string{"www"}, Priority: 1}},
+			domain: "www.example.com.",
+			want:   1,
+		},
+		{
+			name:   "query type",
+			rules:  []Rule{{Domain: []string{"www.example.com"}, QType: []uint16{dns.TypeAAAA}}, {Suffix: []string{"example.com"}}},
+			domain: "www.example.com.",
+			qType:  dns.TypeA,
+			want:   1,
+		},
+		{
+			name:   "client group",
+			rules:  []Rule{{Suffix: []string{"example.com"}}, {ClientGroup: []string{"kids"}}},
+			domain: "www.example.net.",
+			group:  "kids",
+			want:   1,
+		},
+		{
+			name:   "client group without domain condition is less specific",
+			rules:  []Rule{{ClientGroup: []string{"kids"}}, {Suffix: []string{"example.com"}}},
+			domain: "www.example.com.",
+			group:  "kids",
+			want:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matcher := NewMatcher()
+			for index, rule := range test.rules {
+				if err := matcher.Set(index, rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+			qType := test.qType
+			if qType == 0 {
+				qType = dns.TypeA
+			}
+			if got := matcher.Match(test.domain, qType, test.group); got != test.want {
+				t.Errorf("Match(%q) = %d, want %d", test.domain, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetReplacesRule(t *testing.T) {
+	matcher := NewMatcher()
+	if err := matcher.Set(0, Rule{Suffix: []string{"example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := matcher.Set(0, Rule{Suffix: []string{"example.org"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := matcher.Match("www.example.com.", dns.TypeA, ""); got != -1 {
+		t.Errorf("Match(www.example.com.) = %d, want -1", got)
+	}
+	if got := matcher.Match("www.example.org.", dns.TypeA, ""); got != 0 {
+		t.Errorf("Match(www.example.org.) = %d, want 0", got)
+	}
+}
+
+// linearMatcher is the previous matcher, which compares the domain name with every domain and suffix
+func linearMatcher(domain, suffix []string) func(string) bool {
+	domainList := make([]string, len(domain))
+	for index, d := range domain {
+		domainList[index] = strings.Trim(d, ".")
+	}
+
+	suffixList := make([]string, len(suffix))
+	for index, s := range suffix {
+		suffixList[index] = "." + strings.Trim(s, ".")
+	}
+
+	return func(domain string) bool {
+		trimmedDomain := strings.Trim(domain, ".")
+
+		for _, d := range domainList {
+			if trimmedDomain == d {
+				return true
+			}
+		}
+
+		trimmedDomain = "." + trimmedDomain
+		for _, s := range suffixList {
+			if strings.HasSuffix(trimmedDomain, s) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+const benchmarkSuffixes = 200000
+
+func benchmarkSuffixList() []string {
+	suffix := make([]string, benchmarkSuffixes)
+	for index := range suffix {
+		suffix[index] = fmt.Sprintf("domain%d.example%d.com", index, index%100)
+	}
+	return suffix
+}
+
+var benchmarkDomains = []string{
+	"www.domain199999.example99.com.", // last one of the list
+	"a.b.c.domain100000.example0.com.",
+	"www.not-in-the-list.com.",
+}
+
+func BenchmarkLinearMatch(b *testing.B) {
+	match := linearMatcher(nil, benchmarkSuffixList())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		match(benchmarkDomains[i%len(benchmarkDomains)])
+	}
+}
+
+func BenchmarkMatcherMatch(b *testing.B) {
+	matcher := NewMatcher()
+	if err := matcher.Set(0, Rule{Suffix: benchmarkSuffixList()}); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher.Match(benchmarkDomains[i%len(benchmarkDomains)], dns.TypeA, "")
+	}
+}
+
+// BenchmarkMatcherMatchRules matches against many rules, like the previous handler scanning every custom resolver
+func BenchmarkMatcherMatchRules(b *testing.B) {
+	matcher := NewMatcher()
+	for index, suffix := range benchmarkSuffixList()[:10000] {
+		if err := matcher.Set(index, Rule{Suffix: []string{suffix}}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher.Match(benchmarkDomains[i%len(benchmarkDomains)], dns.TypeA, "")
+	}
+}
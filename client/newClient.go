@@ -1,117 +1,214 @@
 package client
 
 import (
-	"context"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
 	"net"
-	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/jinliming2/secure-dns/client/cache"
+	"github.com/jinliming2/secure-dns/client/matcher"
+	"github.com/jinliming2/secure-dns/client/ratelimit"
 	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/jinliming2/secure-dns/client/watcher"
 	"github.com/jinliming2/secure-dns/config"
 	"github.com/jinliming2/secure-dns/selector"
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
 // NewClient returns a client with dnsClients
 func NewClient(logger *zap.SugaredLogger, conf *config.Config) (client *Client, err error) {
 	timeout := time.Duration(*conf.Config.Timeout) * time.Second
-	client = &Client{logger: logger, timeout: timeout, cacheNoAnswer: conf.Config.CacheNoAnswer}
+	client = &Client{
+		logger:         logger,
+		timeout:        timeout,
+		pools:          make(map[string]selector.Selector),
+		customMatcher:  matcher.NewMatcher(),
+		rewriteMatcher: matcher.NewMatcher(),
+		zoneMatcher:    matcher.NewMatcher(),
+		acl:            newAccessControl(conf.Config.Allow, conf.Config.Deny),
+		listenerACL:    make(map[string]*accessControl, len(conf.Listener)),
+		denyAction:     conf.Config.DenyAction,
+		bogusNXDomain:  conf.Config.BogusNXDomain,
+		blockAnswerIP:  conf.Config.BlockAnswerIP,
+		svcb:           svcbPolicy{policy: conf.Config.SVCBPolicy, stripECH: conf.Config.SVCBStripECH},
+		cacheNoAnswer:  conf.Config.CacheNoAnswer,
+		hostsTTL:       *conf.Config.HostsTTL,
+		bootstrap:      resolver.NewBootstrap(logger),
+	}
 
-	switch conf.Config.RoundRobin {
-	case config.SelectorClock:
-		client.upstream = &selector.Clock{}
-	case config.SelectorRandom:
-		client.upstream = &selector.Random{}
-	case config.SelectorSWRR:
-		client.upstream = &selector.SWrr{}
-	case config.SelectorWRandom:
-		client.upstream = &selector.WRandom{}
-	default:
-		err = fmt.Errorf("no such round robin: %s", conf.Config.RoundRobin)
+	if conf.Config.RateLimit > 0 {
+		client.limiter = ratelimit.NewLimiter(
+			conf.Config.RateLimit,
+			conf.Config.RateLimitBurst,
+			conf.Config.RateLimitIPv4Prefix,
+			conf.Config.RateLimitIPv6Prefix,
+		)
+		client.rateLimitSlip = uint32(*conf.Config.RateLimitSlip)
+	}
+
+	for address, listener := range conf.Listener {
+		client.listenerACL[address] = newAccessControl(listener.Allow, listener.Deny)
+	}
+
+	if client.upstream, err = newSelector(conf.Config.RoundRobin); err != nil {
 		return
 	}
 
+	client.ipv6 = ipv6Policy{disableAAAA: conf.Config.DisableAAAA, preferIPv4: conf.Config.PreferIPv4}
+
+	if conf.Config.DNS64 {
+		client.dns64 = newDNS64(*conf.Config.DNS64Prefix, conf.Config.DNS64Exclude)
+	}
+
+	for _, group := range conf.ClientGroup {
+		g := &clientGroup{
+			name:          group.Name,
+			cidr:          group.CIDR,
+			upstreamTag:   group.UpstreamTag,
+			customECS:     group.CustomECS,
+			noECS:         group.NoECS,
+			noCache:       group.NoCache,
+			cacheNoAnswer: client.cacheNoAnswer,
+			dns64:         client.dns64,
+			ipv6:          client.ipv6.override(group.DisableAAAA, group.PreferIPv4),
+			svcb:          client.svcb.override(group.SVCBPolicy, group.SVCBStripECH),
+		}
+		if group.CacheNoAnswer != nil {
+			g.cacheNoAnswer = *group.CacheNoAnswer
+		}
+		if group.DNS64 != nil || group.DNS64Prefix != nil {
+			g.dns64 = nil
+			if (group.DNS64 == nil && conf.Config.DNS64) || (group.DNS64 != nil && *group.DNS64) {
+				prefix := conf.Config.DNS64Prefix
+				if group.DNS64Prefix != nil {
+					prefix = group.DNS64Prefix
+				}
+				g.dns64 = newDNS64(*prefix, conf.Config.DNS64Exclude)
+			}
+		}
+		logger.Debugf("new client group: %s %v", g.name, g.cidr)
+		client.groups = append(client.groups, g)
+	}
+
 	logger.Info("creating clients...")
 
-	for domain, b := range conf.Hosts {
-		c := resolver.NewHostsDNSClient(b)
+	if conf.Config.WatchFiles {
+		client.watcher, err = watcher.NewWatcher(logger)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, zone := range conf.Zone {
+		if err = client.addZone(zone.Name, conf.Path(zone.File)); err != nil {
+			return
+		}
+	}
+
+	hostsKeys := make([]string, 0, len(conf.Hosts))
+	for domain := range conf.Hosts {
+		hostsKeys = append(hostsKeys, domain)
+	}
+	sort.Strings(hostsKeys)
+
+	// addresses of exact domain names in hosts, for synthesizing PTR records
+	var ptrNames []string
+	ptrHosts := make(map[string][]net.IP)
+
+	for _, domain := range hostsKeys {
+		hosts := conf.Hosts[domain]
+		ttl := *conf.Config.HostsTTL
+		if hosts.TTL != nil {
+			ttl = *hosts.TTL
+		}
+		c := resolver.NewHostsDNSClient(hosts.Records, ttl)
+		var rule matcher.Rule
+		if rule, err = hosts.Rule(); err != nil {
+			return
+		}
 		if strings.HasPrefix(domain, "$#") || strings.HasPrefix(domain, "=#") {
-			fileName := domain[2:]
-			if filepath.IsLocal(fileName) {
-				fileName = filepath.Join(filepath.Dir(conf.ConfigFile), fileName)
-			}
-			var data []byte
-			data, err = ioutil.ReadFile(fileName)
+			fileName := conf.Path(domain[2:])
+			var domains []string
+			domains, err = readDomainList(fileName)
 			if err != nil {
 				return
 			}
-			lines := strings.Split(string(data), "\n")
-			domains := lines[:0]
-			for _, line := range lines {
-				trimLine := strings.TrimSpace(line)
-				if !strings.HasPrefix(trimLine, "#") {
-					domains = append(domains, trimLine)
-				}
-			}
-			if strings.HasPrefix(domain, "$#") {
+			isSuffix := strings.HasPrefix(domain, "$#")
+			if isSuffix {
 				logger.Debugf("new HOSTS resolver: %d record(s) from file %s (for suffix match)", len(domains), fileName)
-				cr := newCustomResolver(c, []string{}, domains)
-				client.custom = append(client.custom, cr)
 			} else {
 				logger.Debugf("new HOSTS resolver: %d record(s) from file %s", len(domains), fileName)
-				cr := newCustomResolver(c, domains, []string{})
-				client.custom = append(client.custom, cr)
 			}
+			var cr *customResolver
+			cr, err = client.addCustomResolverWithPolicy(c, withDomainList(rule, domains, isSuffix), hosts.AnswerPolicy)
+			if err != nil {
+				return
+			}
+			if client.watcher != nil {
+				if err = client.watchDomainList(fileName, cr, rule, isSuffix); err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		if hosts.DomainSpecified() {
+			logger.Debugf("new HOSTS resolver: %s (for specified domain or suffix use)", domain)
 		} else if strings.HasPrefix(domain, "*.") {
 			domain = domain[2:]
 			logger.Debugf("new HOSTS resolver: %s (for wildcard domain)", domain)
-			cr := newCustomResolver(c, []string{}, []string{domain})
-			client.custom = append(client.custom, cr)
+			rule.Suffix = []string{domain}
 		} else {
 			logger.Debugf("new HOSTS resolver: %s", domain)
-			cr := newCustomResolver(c, []string{domain}, []string{})
-			client.custom = append(client.custom, cr)
+			rule.Domain = []string{domain}
+		}
+		if _, err = client.addCustomResolverWithPolicy(c, rule, hosts.AnswerPolicy); err != nil {
+			return
+		}
+		if len(rule.ClientGroup) == 0 {
+			ptrNames = addHostsAddresses(ptrNames, ptrHosts, rule.Domain, hosts.Records)
 		}
 	}
 
-	var randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, file := range conf.Config.HostsFile {
+		if err = client.addHostsFile(conf.Path(file), *conf.Config.HostsTTL); err != nil {
+			return
+		}
+	}
 
-traditionalLoop:
-	for _, traditional := range conf.Traditional {
-		if traditional.Bootstrap {
-			logger.Debugf("new traditional resolver: %s (for bootstrap)", fmt.Sprintf("dns://%s:%d", traditional.Host, traditional.Port))
-			if client.bootstrap != nil {
-				logger.Warnf("only one bootstrap resolver allowed, ignoring %s...", fmt.Sprintf("dns://%s:%d", traditional.Host, traditional.Port))
-				continue
-			}
-			if len(traditional.Domain)+len(traditional.Suffix) > 0 {
-				logger.Warn("domain and suffix doesn't support for bootstrap resolver")
-			}
-			count := len(traditional.Host)
-			addresses := make([]string, count)
-			for index, host := range traditional.Host {
-				if addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, traditional.Port)); err == nil {
-					addresses[index] = addr.String()
-				} else if addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("[%s]:%d", host, traditional.Port)); err == nil {
-					addresses[index] = addr.String()
-				} else {
-					logger.Warnf("parse bootstrap address failed: %s:%d, [%s]:%d", host, traditional.Port, host, traditional.Port)
-					continue traditionalLoop
-				}
-			}
-			client.bootstrap = &net.Resolver{
-				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-					return (&net.Dialer{}).DialContext(ctx, network, addresses[randomSource.Intn(count)])
-				},
-			}
-			continue
+	if len(ptrHosts) > 0 {
+		c := resolver.NewHostsFileDNSClient("HOSTS PTR resolver", *conf.Config.HostsTTL)
+		c.Set(ptrNames, ptrHosts)
+		logger.Debugf("new HOSTS resolver: PTR records of %d domain name(s)", len(ptrNames))
+		if _, err = client.addCustomResolver(c, matcher.Rule{Domain: c.ReverseNames(), QType: []uint16{dns.TypePTR}}); err != nil {
+			return
 		}
+	}
 
+	for _, rewrite := range conf.Rewrite {
+		var rule matcher.Rule
+		if rule, err = rewrite.Rule(); err != nil {
+			return
+		}
+		rw := &rewriteRule{
+			cname: rewrite.CNAME,
+			alias: rewrite.Alias,
+			ipv4:  rewrite.IPv4,
+			ipv6:  rewrite.IPv6,
+
+			svcbPolicy:   rewrite.SVCBPolicy,
+			svcbStripECH: rewrite.SVCBStripECH,
+		}
+		if err = client.addRewrite(rw, rule); err != nil {
+			return
+		}
+		logger.Debugf("new rewrite rule: %s => %s", rw.condition, rw.String())
+	}
+
+	for _, traditional := range conf.Traditional {
 		dnsConfig := config.DNSSettings{
 			CustomECS:        append(traditional.CustomECS, conf.Config.CustomECS...),
 			FallbackNoECS:    conf.Config.FallbackNoECS || traditional.FallbackNoECS,
@@ -120,13 +217,30 @@ traditionalLoop:
 		}
 		c := resolver.NewTraditionalDNSClient(traditional.Host, traditional.Port, timeout, dnsConfig)
 
-		if len(traditional.Domain)+len(traditional.Suffix) > 0 {
+		if traditional.Bootstrap {
+			logger.Debugf("new traditional resolver: %s (for bootstrap)", c.String())
+			if err := checkBootstrapHost(traditional.Host); err != nil {
+				logger.Warnf("ignoring bootstrap resolver %s: %s", c.String(), err.Error())
+				continue
+			}
+			if traditional.CustomSpecified() {
+				logger.Warn("domain and suffix doesn't support for bootstrap resolver")
+			}
+			client.bootstrap.Add(c)
+		} else if traditional.CustomSpecified() {
 			logger.Debugf("new traditional resolver: %s (for specified domain or suffix use)", c.String())
-			cr := newCustomResolver(c, traditional.Domain, traditional.Suffix)
-			client.custom = append(client.custom, cr)
+			var rule matcher.Rule
+			if rule, err = traditional.Rule(); err != nil {
+				return
+			}
+			if _, err = client.addCustomResolverWithPolicy(c, rule, traditional.AnswerPolicy); err != nil {
+				return
+			}
 		} else {
 			logger.Debugf("new traditional resolver: %s", c.String())
-			client.upstream.Add(traditional.Weight, c)
+			if err = client.addUpstream(traditional.Tag, traditional.Weight, c, conf.Config.RoundRobin); err != nil {
+				return
+			}
 		}
 	}
 
@@ -137,19 +251,54 @@ traditionalLoop:
 			NoECS:            conf.Config.NoECS || tls.NoECS,
 			NoSingleInflight: conf.Config.NoSingleInflight || tls.NoSingleInflight,
 		}
-		c, err := resolver.NewTLSDNSClient(tls.Host, tls.Port, tls.Hostname, timeout, dnsConfig, client.bootstrap)
+		bootstrap := client.bootstrap
+		if tls.Bootstrap {
+			// bootstrap resolver connects to ip addresses directly
+			bootstrap = nil
+		}
+		tlsSettings := tls.TLSSettings
+		tlsSettings.CAFile = conf.Path(tlsSettings.CAFile)
+		clientCert, err := client.loadClientCertificate(conf, tls.TLSSettings)
+		if err != nil {
+			return client, err
+		}
+		c, err := resolver.NewTLSDNSClient(tls.Host, tls.Port, tls.Hostname, timeout, dnsConfig, tlsSettings, clientCert, bootstrap)
 		if err != nil {
 			logger.Error(err)
 			continue
 		}
+		for _, server := range tls.StampBootstrap {
+			b := resolver.NewTraditionalDNSClient(server.Host, server.Port, timeout, config.DNSSettings{})
+			logger.Debugf("new traditional resolver: %s (for bootstrap of %v)", b.String(), tls.Host)
+			for _, host := range tls.Host {
+				client.bootstrap.AddFor(host, b)
+			}
+		}
 
-		if len(tls.Domain)+len(tls.Suffix) > 0 {
+		if tls.Bootstrap {
+			logger.Debugf("new TLS resolver: %s (for bootstrap)", c.String())
+			if err := checkBootstrapHost(tls.Host); err != nil {
+				logger.Warnf("ignoring bootstrap resolver %s: %s", c.String(), err.Error())
+				continue
+			}
+			if tls.CustomSpecified() {
+				logger.Warn("domain and suffix doesn't support for bootstrap resolver")
+			}
+			client.bootstrap.Add(c)
+		} else if tls.CustomSpecified() {
 			logger.Debugf("new TLS resolver: %s (for specified domain or suffix use)", c.String())
-			cr := newCustomResolver(c, tls.Domain, tls.Suffix)
-			client.custom = append(client.custom, cr)
+			rule, err := tls.Rule()
+			if err != nil {
+				return client, err
+			}
+			if _, err = client.addCustomResolverWithPolicy(c, rule, tls.AnswerPolicy); err != nil {
+				return client, err
+			}
 		} else {
 			logger.Debugf("new TLS resolver: %s", c.String())
-			client.upstream.Add(tls.Weight, c)
+			if err = client.addUpstream(tls.Tag, tls.Weight, c, conf.Config.RoundRobin); err != nil {
+				return client, err
+			}
 		}
 	}
 
@@ -166,8 +315,18 @@ traditionalLoop:
 		} else if conf.Config.UserAgent != "" {
 			dnsConfig.UserAgent = conf.Config.UserAgent
 		}
+		bootstrap := client.bootstrap
+		if https.Bootstrap {
+			// bootstrap resolver connects to ip addresses directly
+			bootstrap = nil
+		}
+		tlsSettings := https.TLSSettings
+		tlsSettings.CAFile = conf.Path(tlsSettings.CAFile)
+		clientCert, err := client.loadClientCertificate(conf, https.TLSSettings)
+		if err != nil {
+			return client, err
+		}
 		var c resolver.DNSClient
-		var err error
 		if https.Google {
 			c, err = resolver.NewHTTPSGoogleDNSClient(
 				https.Host,
@@ -177,7 +336,10 @@ traditionalLoop:
 				https.Cookie,
 				timeout,
 				dnsConfig,
-				client.bootstrap,
+				https.HTTPSettings,
+				tlsSettings,
+				clientCert,
+				bootstrap,
 				logger,
 			)
 		} else {
@@ -186,10 +348,14 @@ traditionalLoop:
 				https.Port,
 				https.Hostname,
 				https.Path,
+				https.ODoHProxy,
 				https.Cookie,
 				timeout,
 				dnsConfig,
-				client.bootstrap,
+				https.HTTPSettings,
+				tlsSettings,
+				clientCert,
+				bootstrap,
 				logger,
 			)
 		}
@@ -197,23 +363,248 @@ traditionalLoop:
 			logger.Error(err)
 			continue
 		}
+		for _, server := range https.StampBootstrap {
+			b := resolver.NewTraditionalDNSClient(server.Host, server.Port, timeout, config.DNSSettings{})
+			logger.Debugf("new traditional resolver: %s (for bootstrap of %v)", b.String(), https.Host)
+			for _, host := range https.Host {
+				client.bootstrap.AddFor(host, b)
+			}
+		}
 
-		if len(https.Domain)+len(https.Suffix) > 0 {
+		if https.Bootstrap {
+			logger.Debugf("new HTTPS resolver: %s (for bootstrap)", c.String())
+			if err := checkBootstrapHost(https.Host); err != nil {
+				logger.Warnf("ignoring bootstrap resolver %s: %s", c.String(), err.Error())
+				continue
+			}
+			if https.CustomSpecified() {
+				logger.Warn("domain and suffix doesn't support for bootstrap resolver")
+			}
+			client.bootstrap.Add(c)
+		} else if https.CustomSpecified() {
 			logger.Debugf("new HTTPS resolver: %s (for specified domain or suffix use)", c.String())
-			cr := newCustomResolver(c, https.Domain, https.Suffix)
-			client.custom = append(client.custom, cr)
+			rule, err := https.Rule()
+			if err != nil {
+				return client, err
+			}
+			if _, err = client.addCustomResolverWithPolicy(c, rule, https.AnswerPolicy); err != nil {
+				return client, err
+			}
 		} else {
 			logger.Debugf("new HTTPS resolver: %s", c.String())
-			client.upstream.Add(https.Weight, c)
+			if err = client.addUpstream(https.Tag, https.Weight, c, conf.Config.RoundRobin); err != nil {
+				return client, err
+			}
+		}
+	}
+
+	for _, dnsCrypt := range conf.DNSCrypt {
+		dnsConfig := config.DNSSettings{
+			CustomECS:        append(dnsCrypt.CustomECS, conf.Config.CustomECS...),
+			FallbackNoECS:    conf.Config.FallbackNoECS || dnsCrypt.FallbackNoECS,
+			NoECS:            conf.Config.NoECS || dnsCrypt.NoECS,
+			NoSingleInflight: conf.Config.NoSingleInflight || dnsCrypt.NoSingleInflight,
+		}
+		stamp, err := config.ParseStamp(dnsCrypt.Stamp)
+		if err != nil {
+			return client, err
+		}
+		c, err := resolver.NewDNSCryptClient(stamp, timeout, dnsConfig)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		if dnsCrypt.CustomSpecified() {
+			logger.Debugf("new DNSCrypt resolver: %s (for specified domain or suffix use)", c.String())
+			rule, err := dnsCrypt.Rule()
+			if err != nil {
+				return client, err
+			}
+			if _, err = client.addCustomResolverWithPolicy(c, rule, dnsCrypt.AnswerPolicy); err != nil {
+				return client, err
+			}
+		} else {
+			logger.Debugf("new DNSCrypt resolver: %s", c.String())
+			if err = client.addUpstream(dnsCrypt.Tag, dnsCrypt.Weight, c, conf.Config.RoundRobin); err != nil {
+				return client, err
+			}
 		}
 	}
 
 	client.upstream.Start()
+	for _, pool := range client.pools {
+		pool.Start()
+	}
 	logger.Infof("using round robin: %s", client.upstream.Name())
+	if servers := client.bootstrap.Servers(); len(servers) > 0 {
+		logger.Infof("using bootstrap: %s", strings.Join(servers, ", "))
+	} else {
+		logger.Info("using bootstrap: system resolver")
+	}
+
+	if conf.Config.FallbackTag != "" {
+		if err = client.setupAnswerFallback(conf); err != nil {
+			return
+		}
+	}
+
+	if conf.Config.RebindProtection {
+		if client.rebind, err = newRebindProtection(conf.Config.RebindAllow); err != nil {
+			return
+		}
+	}
+
+	for _, group := range client.groups {
+		if group.upstreamTag == "" {
+			continue
+		}
+		var ok bool
+		if group.upstream, ok = client.pools[group.upstreamTag]; !ok {
+			err = fmt.Errorf("no upstream tagged %s for client group %s", group.upstreamTag, group.name)
+			return
+		}
+	}
+	client.logRoutingTable()
 
 	if !conf.Config.NoCache {
 		client.cacher = cache.NewCache()
 	}
 
+	if *conf.Config.BootstrapRefresh > 0 {
+		client.bootstrap.StartRefresh(time.Duration(*conf.Config.BootstrapRefresh)*time.Second, client.resolveUpstreamHost)
+	}
+
 	return
 }
+
+func (client *Client) setupAnswerFallback(conf *config.Config) error {
+	pool, ok := client.pools[conf.Config.FallbackTag]
+	if !ok {
+		return fmt.Errorf("no upstream tagged %s for fallback", conf.Config.FallbackTag)
+	}
+	client.answerFallback = &answerFallback{
+		upstream: pool,
+		expectIP: conf.Config.FallbackExpectIP,
+		bogusIP:  conf.Config.FallbackBogusIP,
+	}
+	logger := client.logger
+	logger.Debugf("using upstream tagged %s as fallback", conf.Config.FallbackTag)
+
+	if conf.Config.FallbackExpectIPFile == "" {
+		return nil
+	}
+	fileName := conf.Path(conf.Config.FallbackExpectIPFile)
+	list, err := readCIDRList(fileName)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("loaded %d expected network(s) for fallback from file %s", len(list), fileName)
+	client.answerFallback.setExpectIP(append(list, conf.Config.FallbackExpectIP...))
+
+	if client.watcher == nil {
+		return nil
+	}
+	return client.watcher.Add(fileName, func() {
+		list, err := readCIDRList(fileName)
+		if err != nil {
+			logger.Warnf("failed to reload %s: %s", fileName, err.Error())
+			return
+		}
+		client.answerFallback.setExpectIP(append(list, conf.Config.FallbackExpectIP...))
+		if client.cacher != nil {
+			client.cacher.Clear()
+		}
+		logger.Infof("reloaded %d expected network(s) for fallback from file %s", len(list), fileName)
+	})
+}
+
+func newSelector(roundRobin config.Selectors) (selector.Selector, error) {
+	switch roundRobin {
+	case config.SelectorClock:
+		return &selector.Clock{}, nil
+	case config.SelectorRandom:
+		return &selector.Random{}, nil
+	case config.SelectorSWRR:
+		return &selector.SWrr{}, nil
+	case config.SelectorWRandom:
+		return &selector.WRandom{}, nil
+	default:
+		return nil, fmt.Errorf("no such round robin: %s", roundRobin)
+	}
+}
+
+// addUpstream adds c to default upstream, or to the upstream pool of tag
+func (client *Client) addUpstream(tag string, weight int32, c resolver.DNSClient, roundRobin config.Selectors) error {
+	if tag == "" {
+		client.upstream.Add(weight, c)
+		return nil
+	}
+	pool, ok := client.pools[tag]
+	if !ok {
+		var err error
+		if pool, err = newSelector(roundRobin); err != nil {
+			return err
+		}
+		client.pools[tag] = pool
+	}
+	pool.Add(weight, c)
+	return nil
+}
+
+// watchDomainList reloads domain list of cr after fileName changed
+func (client *Client) watchDomainList(fileName string, cr *customResolver, rule matcher.Rule, isSuffix bool) error {
+	return client.watcher.Add(fileName, func() {
+		domains, err := readDomainList(fileName)
+		if err != nil {
+			client.logger.Warnf("failed to reload %s: %s", fileName, err.Error())
+			return
+		}
+		if err := client.updateCustomResolver(cr, withDomainList(rule, domains, isSuffix)); err != nil {
+			client.logger.Warnf("failed to reload %s: %s", fileName, err.Error())
+			return
+		}
+		if client.cacher != nil {
+			client.cacher.Clear()
+		}
+		client.logger.Infof("reloaded %d record(s) from file %s", len(domains), fileName)
+	})
+}
+
+// addHostsAddresses adds A and AAAA records of domains without glob patterns to hosts, and returns appended names
+func addHostsAddresses(names []string, hosts map[string][]net.IP, domains []string, records map[string][]string) []string {
+	for _, domain := range domains {
+		if strings.ContainsAny(domain, "*?") {
+			continue
+		}
+		for _, record := range append(append([]string{}, records["A"]...), records["AAAA"]...) {
+			if ip := net.ParseIP(strings.TrimSpace(record)); ip != nil {
+				if _, ok := hosts[domain]; !ok {
+					names = append(names, domain)
+				}
+				hosts[domain] = append(hosts[domain], ip)
+			}
+		}
+	}
+	return names
+}
+
+// withDomainList returns a copy of rule with domains appended to its domain or suffix list
+func withDomainList(rule matcher.Rule, domains []string, isSuffix bool) matcher.Rule {
+	if isSuffix {
+		rule.Suffix = append(append([]string{}, rule.Suffix...), domains...)
+	} else {
+		rule.Domain = append(append([]string{}, rule.Domain...), domains...)
+	}
+	return rule
+}
+
+// checkBootstrapHost checks that hosts of a bootstrap DNS server are all ip addresses
+func checkBootstrapHost(host []string) error {
+	for _, h := range host {
+		if net.ParseIP(h) == nil {
+			return fmt.Errorf("host of bootstrap DNS server should be an ip address: %s", h)
+		}
+	}
+	return nil
+}
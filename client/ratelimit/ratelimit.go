@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint32
+}
+
+// Limiter limits request rate of clients with token buckets, keyed by client ip prefix
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	ipv4    net.IPMask
+	ipv6    net.IPMask
+	buckets map[string]*bucket
+	done    chan<- bool
+}
+
+// NewLimiter returns a limiter allows rate requests per second with burst for each ipv4 or ipv6 prefix
+func NewLimiter(rate, burst uint, ipv4Prefix, ipv6Prefix int) (limiter *Limiter) {
+	ticker := time.NewTicker(30 * time.Second)
+	done := make(chan bool, 0)
+
+	limiter = &Limiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		ipv4:    net.CIDRMask(ipv4Prefix, 32),
+		ipv6:    net.CIDRMask(ipv6Prefix, 128),
+		buckets: make(map[string]*bucket),
+		done:    done,
+	}
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				limiter.clean()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return
+}
+
+// Allow reports whether a request from ip is allowed,
+// and how many requests from the same prefix have been limited in a row if not.
+// Requests from unknown ip (nil) are not limited, instead of sharing a bucket with each other
+func (limiter *Limiter) Allow(ip net.IP) (bool, uint32) {
+	if ip == nil {
+		return true, 0
+	}
+	key := limiter.key(ip)
+	now := time.Now()
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+		if b.tokens > limiter.burst {
+			b.tokens = limiter.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return true, 0
+	}
+	b.limited++
+	return false, b.limited
+}
+
+func (limiter *Limiter) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(limiter.ipv4).String()
+	}
+	return ip.Mask(limiter.ipv6).String()
+}
+
+// clean removes buckets which are already full
+func (limiter *Limiter) clean() {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+
+	for key, b := range limiter.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Destroy limiter, stop cleaning tick
+func (limiter *Limiter) Destroy() {
+	close(limiter.done)
+}
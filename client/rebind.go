@@ -0,0 +1,73 @@
+package client
+
+import (
+	"net"
+
+	"github.com/jinliming2/secure-dns/client/matcher"
+	"github.com/jinliming2/secure-dns/config"
+	"github.com/miekg/dns"
+)
+
+// networks which public domain names should never resolve to
+var privateNetworks config.CIDRList
+
+func init() {
+	for _, network := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, ipNet, _ := net.ParseCIDR(network)
+		privateNetworks = append(privateNetworks, config.CIDR{IPNet: *ipNet})
+	}
+}
+
+// rebindProtection removes private addresses from answers of domain names not in the allow list
+type rebindProtection struct {
+	allow *matcher.Matcher
+}
+
+func newRebindProtection(allow []string) (*rebindProtection, error) {
+	protection := &rebindProtection{allow: matcher.NewMatcher()}
+	if len(allow) > 0 {
+		if err := protection.allow.Set(0, matcher.Rule{Suffix: allow}); err != nil {
+			return nil, err
+		}
+	}
+	return protection, nil
+}
+
+// filter removes A and AAAA records with private addresses from response,
+// unless their owner names are in the allow list, so that a CNAME of an allowed name is still checked.
+// response is rewritten to NXDOMAIN if no address is left
+func (protection *rebindProtection) filter(response *dns.Msg) (removed []net.IP) {
+	if response.Rcode != dns.RcodeSuccess {
+		return
+	}
+	removeAnswers(response, func(name string, ip net.IP) bool {
+		if isPrivate(ip) && protection.allow.Match(name, 0, "") < 0 {
+			removed = append(removed, ip)
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// isPrivate reports whether ip is in privateNetworks, IPv4-mapped IPv6 addresses are checked as IPv4 addresses
+func isPrivate(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return privateNetworks.Contains(ip)
+}
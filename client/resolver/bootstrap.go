@@ -0,0 +1,280 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// addresses are cached at least minBootstrapTTL, and at most maxBootstrapTTL
+	minBootstrapTTL = 60 * time.Second
+	maxBootstrapTTL = 24 * time.Hour
+)
+
+type bootstrapEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// Bootstrap resolves host names of DNS servers, resolved addresses are cached with TTL.
+//
+// Bootstrap DNS servers are tried in order until one of them answers,
+// the system resolver is used if there is no bootstrap DNS server.
+// DNS servers added for a host name are tried before them.
+//
+// After StartRefresh, resolved addresses are pinned and re-resolved periodically with the given resolve function,
+// bootstrap DNS servers are only used for host names which are not resolved yet.
+type Bootstrap struct {
+	logger *zap.SugaredLogger
+
+	mu          sync.Mutex
+	clients     []DNSClient
+	hostClients map[string][]DNSClient
+	cache       map[string]*bootstrapEntry
+	pinned      bool
+	done        chan<- bool
+}
+
+// NewBootstrap returns a bootstrap without DNS server
+func NewBootstrap(logger *zap.SugaredLogger) *Bootstrap {
+	return &Bootstrap{
+		logger:      logger,
+		hostClients: make(map[string][]DNSClient),
+		cache:       make(map[string]*bootstrapEntry),
+	}
+}
+
+// Add a bootstrap DNS server, it should be able to connect without resolving host names
+func (bootstrap *Bootstrap) Add(client DNSClient) {
+	bootstrap.mu.Lock()
+	defer bootstrap.mu.Unlock()
+	bootstrap.clients = append(bootstrap.clients, client)
+}
+
+// AddFor adds a DNS server which is only used to resolve host, such as bootstrap recommended by DNS stamp
+func (bootstrap *Bootstrap) AddFor(host string, client DNSClient) {
+	if net.ParseIP(host) != nil {
+		return
+	}
+	name := dns.Fqdn(host)
+	bootstrap.mu.Lock()
+	defer bootstrap.mu.Unlock()
+	bootstrap.hostClients[name] = append(bootstrap.hostClients[name], client)
+}
+
+// Servers returns names of bootstrap DNS servers
+func (bootstrap *Bootstrap) Servers() []string {
+	bootstrap.mu.Lock()
+	defer bootstrap.mu.Unlock()
+	names := make([]string, len(bootstrap.clients))
+	for index, client := range bootstrap.clients {
+		names[index] = client.String()
+	}
+	return names
+}
+
+// LookupIP returns addresses of host
+func (bootstrap *Bootstrap) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := dns.Fqdn(host)
+
+	bootstrap.mu.Lock()
+	entry, ok := bootstrap.cache[name]
+	clients := bootstrap.clients
+	hostClients := bootstrap.hostClients[name]
+	pinned := bootstrap.pinned
+	bootstrap.mu.Unlock()
+
+	if ok && (pinned || time.Now().Before(entry.expire)) {
+		return entry.ips, nil
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if len(hostClients) > 0 {
+		ips, ttl, err = bootstrap.lookupClients(hostClients, name)
+	}
+	if len(hostClients) == 0 || err != nil {
+		if len(clients) == 0 {
+			var addrs []net.IPAddr
+			if addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host); err == nil {
+				for _, addr := range addrs {
+					ips = append(ips, addr.IP)
+				}
+			}
+		} else {
+			ips, ttl, err = bootstrap.lookupClients(clients, name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl < minBootstrapTTL {
+		ttl = minBootstrapTTL
+	} else if ttl > maxBootstrapTTL {
+		ttl = maxBootstrapTTL
+	}
+	bootstrap.mu.Lock()
+	bootstrap.cache[name] = &bootstrapEntry{ips: ips, expire: time.Now().Add(ttl)}
+	bootstrap.mu.Unlock()
+	bootstrap.logger.Debugf("bootstrap: %s resolved to %v", host, ips)
+
+	return ips, nil
+}
+
+// lookupClients looks up name with clients in order, returns addresses and the min TTL
+func (bootstrap *Bootstrap) lookupClients(clients []DNSClient, name string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, client := range clients {
+		client := client
+		ips, ttl, err := lookup(name, func(request *dns.Msg) (*dns.Msg, error) {
+			reply, err := client.Resolve(request, ResolveOptions{ForceNoECS: true})
+			if err == nil && reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+				err = fmt.Errorf("bootstrap %s answered %s with %s", client.String(), name, dns.RcodeToString[reply.Rcode])
+			}
+			return reply, err
+		})
+		if err == nil && len(ips) == 0 {
+			// the next bootstrap DNS server may still answer
+			err = fmt.Errorf("bootstrap %s: no address of %s", client.String(), name)
+		}
+		if err != nil {
+			bootstrap.logger.Warn(err.Error())
+			lastErr = err
+			continue
+		}
+		return ips, ttl, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no bootstrap DNS server")
+	}
+	return nil, 0, lastErr
+}
+
+// lookup A and AAAA records of name with resolve, returns addresses and the min TTL
+func lookup(name string, resolve func(request *dns.Msg) (*dns.Msg, error)) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var minTTL uint32
+	for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		reply, err := resolve(new(dns.Msg).SetQuestion(name, qType))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, answer := range reply.Answer {
+			var ip net.IP
+			switch rr := answer.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			ips = append(ips, ip)
+			if ttl := answer.Header().Ttl; minTTL == 0 || ttl < minTTL {
+				minTTL = ttl
+			}
+		}
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+// StartRefresh pins resolved addresses, and re-resolves them with resolve every interval
+func (bootstrap *Bootstrap) StartRefresh(interval time.Duration, resolve func(request *dns.Msg) (*dns.Msg, error)) {
+	ticker := time.NewTicker(interval)
+	done := make(chan bool, 0)
+
+	bootstrap.mu.Lock()
+	bootstrap.pinned = true
+	bootstrap.done = done
+	bootstrap.mu.Unlock()
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				bootstrap.refresh(resolve)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// refresh re-resolves all cached host names, addresses are kept if failed to resolve
+func (bootstrap *Bootstrap) refresh(resolve func(request *dns.Msg) (*dns.Msg, error)) {
+	bootstrap.mu.Lock()
+	names := make([]string, 0, len(bootstrap.cache))
+	for name := range bootstrap.cache {
+		names = append(names, name)
+	}
+	bootstrap.mu.Unlock()
+
+	for _, name := range names {
+		ips, _, err := lookup(name, func(request *dns.Msg) (*dns.Msg, error) {
+			reply, err := resolve(request)
+			if err == nil && reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+				err = fmt.Errorf("answered with %s", dns.RcodeToString[reply.Rcode])
+			}
+			return reply, err
+		})
+		if err == nil && len(ips) == 0 {
+			err = errors.New("no address")
+		}
+		if err != nil {
+			bootstrap.logger.Warnf("bootstrap: failed to refresh %s, keeping pinned addresses: %s", name, err.Error())
+			continue
+		}
+		bootstrap.mu.Lock()
+		bootstrap.cache[name] = &bootstrapEntry{ips: ips}
+		bootstrap.mu.Unlock()
+		bootstrap.logger.Debugf("bootstrap: %s refreshed to %v", name, ips)
+	}
+}
+
+// Destroy stops refreshing
+func (bootstrap *Bootstrap) Destroy() {
+	bootstrap.mu.Lock()
+	defer bootstrap.mu.Unlock()
+	if bootstrap.done != nil {
+		close(bootstrap.done)
+		bootstrap.done = nil
+	}
+}
+
+// DialContext connects to address, host names are resolved with bootstrap,
+// resolved addresses are tried in order until one is connected
+func (bootstrap *Bootstrap) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if bootstrap == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := bootstrap.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,51 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// ClientCertificate is a TLS client certificate loaded from files, which can be reloaded
+type ClientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewClientCertificate loads client certificate from PEM encoded certFile and keyFile
+func NewClientCertificate(certFile, keyFile string) (*ClientCertificate, error) {
+	cert := &ClientCertificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cert.Reload(); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Files returns the certificate file and the key file
+func (cert *ClientCertificate) Files() (string, string) {
+	return cert.certFile, cert.keyFile
+}
+
+// Reload certificate from files, the old one is kept if failed
+func (cert *ClientCertificate) Reload() error {
+	c, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+	if err != nil {
+		return err
+	}
+	cert.mu.Lock()
+	defer cert.mu.Unlock()
+	cert.cert = &c
+	return nil
+}
+
+// getClientCertificate is used as GetClientCertificate of tls.Config
+func (cert *ClientCertificate) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert.mu.RLock()
+	defer cert.mu.RUnlock()
+	return cert.cert, nil
+}
@@ -0,0 +1,448 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinliming2/secure-dns/config"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/sync/singleflight"
+)
+
+// encryption systems of DNSCrypt certificates
+const (
+	dnsCryptXSalsa20Poly1305  uint16 = 0x0001
+	dnsCryptXChacha20Poly1305 uint16 = 0x0002
+)
+
+const (
+	dnsCryptCertSize     = 124
+	dnsCryptNonceSize    = 24
+	dnsCryptTagSize      = 16
+	dnsCryptMinQuerySize = 256
+	dnsCryptPaddingBlock = 64
+	// certificates are fetched again after dnsCryptCertRefresh, in case of key rotation
+	dnsCryptCertRefresh = time.Hour
+)
+
+var (
+	dnsCryptCertMagic     = []byte("DNSC")
+	dnsCryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+// dnsCryptCert is the certificate of DNSCrypt server, which provides the short-term public key of the server
+type dnsCryptCert struct {
+	esVersion   uint16
+	serial      uint32
+	clientMagic []byte
+	sharedKey   [32]byte
+	notAfter    time.Time
+	fetched     time.Time
+}
+
+// DNSCryptClient resolves DNS with DNSCrypt version 2
+type DNSCryptClient struct {
+	address        string
+	providerName   string
+	providerKey    ed25519.PublicKey
+	publicKey      [32]byte
+	secretKey      [32]byte
+	udpClient      *dns.Client
+	tcpClient      *dns.Client
+	timeout        time.Duration
+	singleInflight *singleflight.Group
+
+	mu   sync.Mutex
+	cert *dnsCryptCert
+	config.DNSSettings
+}
+
+// NewDNSCryptClient returns a new DNSCrypt client of DNS stamp
+func NewDNSCryptClient(stamp *config.Stamp, timeout time.Duration, settings config.DNSSettings) (*DNSCryptClient, error) {
+	if stamp.Protocol != config.StampProtocolDNSCrypt {
+		return nil, fmt.Errorf("not a DNSCrypt stamp: %s", stamp.Protocol.String())
+	}
+	if len(stamp.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key of DNSCrypt provider")
+	}
+	if stamp.ProviderName == "" {
+		return nil, errors.New("no DNSCrypt provider name")
+	}
+	address := stamp.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(trimBrackets(address), "443")
+	}
+
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var sf *singleflight.Group
+	if !settings.NoSingleInflight {
+		sf = &singleflight.Group{}
+	}
+
+	return &DNSCryptClient{
+		address:      address,
+		providerName: dns.Fqdn(stamp.ProviderName),
+		providerKey:  ed25519.PublicKey(stamp.PublicKey),
+		publicKey:    *publicKey,
+		secretKey:    *secretKey,
+		udpClient: &dns.Client{
+			Net:     "udp",
+			UDPSize: dns.DefaultMsgSize,
+			Timeout: timeout,
+		},
+		tcpClient: &dns.Client{
+			Net:     "tcp",
+			Timeout: timeout,
+		},
+		timeout:        timeout,
+		singleInflight: sf,
+		DNSSettings:    settings,
+	}, nil
+}
+
+func (client *DNSCryptClient) String() string {
+	return fmt.Sprintf("dnscrypt://%s@%s", client.providerName, client.address)
+}
+
+func (client *DNSCryptClient) ECSDisabled() bool {
+	return client.NoECS
+}
+
+func (client *DNSCryptClient) FallbackNoECSEnabled() bool {
+	return client.FallbackNoECS
+}
+
+// Resolve DNS
+func (client *DNSCryptClient) Resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
+	return httpsSingleInflightRequest(request, options, client.singleInflight, client.resolve)
+}
+
+func (client *DNSCryptClient) resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
+	setECS(request, &client.DNSSettings, options)
+
+	cert, err := client.getCert()
+	if err != nil {
+		return getEmptyErrorResponse(request), fmt.Errorf("failed to resolve %s using %s: %s", request.Question[0].Name, client.String(), err.Error())
+	}
+
+	msg, err := request.Pack()
+	if err != nil {
+		reply := getEmptyErrorResponse(request)
+		reply.Rcode = dns.RcodeFormatError
+		return reply, err
+	}
+
+	useTCP := options.UseTCP
+	if !useTCP {
+		reply, err := client.exchange(cert, msg, false)
+		if err != nil {
+			return getEmptyErrorResponse(request), fmt.Errorf("failed to resolve %s using %s: %s", request.Question[0].Name, client.String(), err.Error())
+		}
+		if !reply.Truncated {
+			reply.Id = request.Id
+			return reply, nil
+		}
+	}
+	reply, err := client.exchange(cert, msg, true)
+	if err != nil {
+		return getEmptyErrorResponse(request), fmt.Errorf("failed to resolve %s using %s: %s", request.Question[0].Name, client.String(), err.Error())
+	}
+	reply.Id = request.Id
+	return reply, nil
+}
+
+// exchange encrypted DNS message msg with server
+func (client *DNSCryptClient) exchange(cert *dnsCryptCert, msg []byte, useTCP bool) (*dns.Msg, error) {
+	var nonce [dnsCryptNonceSize]byte
+	if _, err := rand.Read(nonce[:dnsCryptNonceSize/2]); err != nil {
+		return nil, err
+	}
+
+	size := len(msg) + 1
+	if !useTCP && size < dnsCryptMinQuerySize {
+		size = dnsCryptMinQuerySize
+	}
+	size = (size + dnsCryptPaddingBlock - 1) / dnsCryptPaddingBlock * dnsCryptPaddingBlock
+	padded := make([]byte, size)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+
+	query := make([]byte, 0, len(cert.clientMagic)+len(client.publicKey)+dnsCryptNonceSize/2+dnsCryptTagSize+size)
+	query = append(query, cert.clientMagic...)
+	query = append(query, client.publicKey[:]...)
+	query = append(query, nonce[:dnsCryptNonceSize/2]...)
+	query = dnsCryptSeal(cert.esVersion, query, padded, &nonce, &cert.sharedKey)
+
+	response, err := client.send(query, useTCP)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response) < len(dnsCryptResolverMagic)+dnsCryptNonceSize+dnsCryptTagSize ||
+		!bytes.Equal(response[:len(dnsCryptResolverMagic)], dnsCryptResolverMagic) {
+		return nil, errors.New("invalid DNSCrypt response")
+	}
+	response = response[len(dnsCryptResolverMagic):]
+	var serverNonce [dnsCryptNonceSize]byte
+	copy(serverNonce[:], response[:dnsCryptNonceSize])
+	if !bytes.Equal(serverNonce[:dnsCryptNonceSize/2], nonce[:dnsCryptNonceSize/2]) {
+		return nil, errors.New("unexpected nonce of DNSCrypt response")
+	}
+	plain, ok := dnsCryptOpen(cert.esVersion, response[dnsCryptNonceSize:], &serverNonce, &cert.sharedKey)
+	if !ok {
+		return nil, errors.New("failed to decrypt DNSCrypt response")
+	}
+	if plain, ok = dnsCryptUnpad(plain); !ok {
+		return nil, errors.New("invalid padding of DNSCrypt response")
+	}
+
+	reply := new(dns.Msg)
+	if err = reply.Unpack(plain); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// send encrypted query to server, and returns the raw response
+func (client *DNSCryptClient) send(query []byte, useTCP bool) ([]byte, error) {
+	network := "udp"
+	if useTCP {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, client.address, client.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if client.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(client.timeout))
+	}
+
+	if !useTCP {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return buffer[:n], nil
+	}
+
+	packet := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(packet, uint16(len(query)))
+	copy(packet[2:], query)
+	if _, err = conn.Write(packet); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// getCert returns the current certificate, certificates are fetched if expired or too old
+func (client *DNSCryptClient) getCert() (*dnsCryptCert, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	now := time.Now()
+	if client.cert != nil && now.Before(client.cert.notAfter) && now.Sub(client.cert.fetched) < dnsCryptCertRefresh {
+		return client.cert, nil
+	}
+	cert, err := client.fetchCert()
+	if err != nil {
+		if client.cert != nil && now.Before(client.cert.notAfter) {
+			return client.cert, nil
+		}
+		return nil, err
+	}
+	client.cert = cert
+	return cert, nil
+}
+
+// fetchCert queries TXT records of provider name, and returns the valid certificate with the highest serial
+func (client *DNSCryptClient) fetchCert() (*dnsCryptCert, error) {
+	request := new(dns.Msg).SetQuestion(client.providerName, dns.TypeTXT)
+	reply, _, err := client.udpClient.Exchange(request, client.address)
+	if err == nil && reply.Truncated {
+		reply, _, err = client.tcpClient.Exchange(request, client.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch DNSCrypt certificate: %s", err.Error())
+	}
+
+	now := time.Now()
+	var best *dnsCryptCert
+	var resolverKey [32]byte
+	for _, answer := range reply.Answer {
+		txt, ok := answer.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		var data []byte
+		for _, str := range txt.Txt {
+			data = append(data, unescapeTXT(str)...)
+		}
+		if len(data) < dnsCryptCertSize || !bytes.Equal(data[:4], dnsCryptCertMagic) {
+			continue
+		}
+		esVersion := binary.BigEndian.Uint16(data[4:6])
+		if esVersion != dnsCryptXSalsa20Poly1305 && esVersion != dnsCryptXChacha20Poly1305 {
+			continue
+		}
+		if !ed25519.Verify(client.providerKey, data[72:], data[8:72]) {
+			continue
+		}
+		notBefore := time.Unix(int64(binary.BigEndian.Uint32(data[116:120])), 0)
+		notAfter := time.Unix(int64(binary.BigEndian.Uint32(data[120:124])), 0)
+		if now.Before(notBefore) || now.After(notAfter) {
+			continue
+		}
+		serial := binary.BigEndian.Uint32(data[112:116])
+		if best != nil && (serial < best.serial || (serial == best.serial && esVersion <= best.esVersion)) {
+			continue
+		}
+		best = &dnsCryptCert{
+			esVersion:   esVersion,
+			serial:      serial,
+			clientMagic: append([]byte{}, data[104:112]...),
+			notAfter:    notAfter,
+			fetched:     now,
+		}
+		copy(resolverKey[:], data[72:104])
+	}
+	if best == nil {
+		return nil, errors.New("no valid DNSCrypt certificate")
+	}
+
+	if err = dnsCryptSharedKey(best.esVersion, &best.sharedKey, &resolverKey, &client.secretKey); err != nil {
+		return nil, err
+	}
+	return best, nil
+}
+
+// dnsCryptSharedKey computes shared key of the encryption system from the public key of resolver and the secret key of client
+func dnsCryptSharedKey(esVersion uint16, sharedKey, resolverKey, secretKey *[32]byte) error {
+	if esVersion == dnsCryptXSalsa20Poly1305 {
+		box.Precompute(sharedKey, resolverKey, secretKey)
+		return nil
+	}
+	dhKey, err := curve25519.X25519(secretKey[:], resolverKey[:])
+	if err != nil {
+		return err
+	}
+	key, err := chacha20.HChaCha20(dhKey, make([]byte, 16))
+	if err != nil {
+		return err
+	}
+	copy(sharedKey[:], key)
+	return nil
+}
+
+// dnsCryptSeal appends encrypted message to out, in the format of NaCl secretbox: tag followed by cipher text
+func dnsCryptSeal(esVersion uint16, out, message []byte, nonce *[dnsCryptNonceSize]byte, key *[32]byte) []byte {
+	if esVersion == dnsCryptXSalsa20Poly1305 {
+		return secretbox.Seal(out, message, nonce, key)
+	}
+
+	cipher, polyKey := xChaCha20Cipher(nonce, key)
+	sealed := make([]byte, dnsCryptTagSize+len(message))
+	cipher.XORKeyStream(sealed[dnsCryptTagSize:], message)
+	var tag [dnsCryptTagSize]byte
+	poly1305.Sum(&tag, sealed[dnsCryptTagSize:], polyKey)
+	copy(sealed, tag[:])
+	return append(out, sealed...)
+}
+
+// dnsCryptOpen decrypts box sealed by dnsCryptSeal
+func dnsCryptOpen(esVersion uint16, sealed []byte, nonce *[dnsCryptNonceSize]byte, key *[32]byte) ([]byte, bool) {
+	if esVersion == dnsCryptXSalsa20Poly1305 {
+		return secretbox.Open(nil, sealed, nonce, key)
+	}
+
+	if len(sealed) < dnsCryptTagSize {
+		return nil, false
+	}
+	cipher, polyKey := xChaCha20Cipher(nonce, key)
+	var tag [dnsCryptTagSize]byte
+	copy(tag[:], sealed[:dnsCryptTagSize])
+	if !poly1305.Verify(&tag, sealed[dnsCryptTagSize:], polyKey) {
+		return nil, false
+	}
+	message := make([]byte, len(sealed)-dnsCryptTagSize)
+	cipher.XORKeyStream(message, sealed[dnsCryptTagSize:])
+	return message, true
+}
+
+// xChaCha20Cipher returns XChaCha20 cipher for message and the Poly1305 key,
+// which is the first 32 bytes of the key stream, the message is encrypted with the rest, the same as NaCl secretbox
+func xChaCha20Cipher(nonce *[dnsCryptNonceSize]byte, key *[32]byte) (*chacha20.Cipher, *[32]byte) {
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+	return cipher, &polyKey
+}
+
+// dnsCryptUnpad removes ISO/IEC 7816-4 padding of message
+func dnsCryptUnpad(message []byte) ([]byte, bool) {
+	index := bytes.LastIndexByte(message, 0x80)
+	if index < 0 || subtle.ConstantTimeCompare(message[index+1:], make([]byte, len(message)-index-1)) != 1 {
+		return nil, false
+	}
+	return message[:index], true
+}
+
+// unescapeTXT converts TXT string in presentation format to raw bytes, e.g. \068 to byte 68, \" to "
+func unescapeTXT(str string) []byte {
+	data := make([]byte, 0, len(str))
+	for index := 0; index < len(str); index++ {
+		if str[index] != '\\' || index+1 >= len(str) {
+			data = append(data, str[index])
+			continue
+		}
+		if index+3 < len(str) {
+			if b, err := strconv.ParseUint(str[index+1:index+4], 10, 8); err == nil {
+				data = append(data, byte(b))
+				index += 3
+				continue
+			}
+		}
+		index++
+		data = append(data, str[index])
+	}
+	return data
+}
+
+// trimBrackets removes brackets of IPv6 address
+func trimBrackets(address string) string {
+	if len(address) > 1 && address[0] == '[' && address[len(address)-1] == ']' {
+		return address[1 : len(address)-1]
+	}
+	return address
+}
@@ -0,0 +1,131 @@
+package resolver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// key, nonce and message of the xsecretbox test of dnscrypt-proxy,
+// expected values are computed by the xsecretbox package
+var (
+	dnsCryptTestKey = [32]byte{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+	}
+	dnsCryptTestNonce = [dnsCryptNonceSize]byte{
+		23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12,
+		11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	}
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDNSCryptSealXChaCha20(t *testing.T) {
+	long := make([]byte, 100)
+	for index := range long {
+		long[index] = byte(index)
+	}
+
+	tests := []struct {
+		name    string
+		message []byte
+		sealed  string
+	}{
+		{
+			name:    "xsecretbox",
+			message: bytes.Repeat([]byte{42}, 10),
+			sealed:  "ef983304e639c461e4a279226451a97b19009e66b1c63cae0e7d",
+		},
+		{
+			name:    "more than one block",
+			message: long,
+			sealed: "1254037c954d1c8f2b6033b239e15ad0332bb64f9fe910832c5eaceeecce9d59" +
+				"d8a8cf7cc09764b5a3573238f290db02c110c93e593c8f373ef0f21fd8f06ae2" +
+				"f97973408d011cdc8113b56ee4e4c6ae227ec044a68e72c07a6efe3321ec5a36" +
+				"0124b50aa5c0ad2bb86d987e8ec727656b225ef7",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := mustDecodeHex(t, test.sealed)
+			sealed := dnsCryptSeal(dnsCryptXChacha20Poly1305, nil, test.message, &dnsCryptTestNonce, &dnsCryptTestKey)
+			if !bytes.Equal(sealed, want) {
+				t.Fatalf("dnsCryptSeal() = %x, want %x", sealed, want)
+			}
+
+			message, ok := dnsCryptOpen(dnsCryptXChacha20Poly1305, sealed, &dnsCryptTestNonce, &dnsCryptTestKey)
+			if !ok || !bytes.Equal(message, test.message) {
+				t.Fatalf("dnsCryptOpen() = %x, %v, want %x", message, ok, test.message)
+			}
+
+			sealed[0]++
+			if _, ok := dnsCryptOpen(dnsCryptXChacha20Poly1305, sealed, &dnsCryptTestNonce, &dnsCryptTestKey); ok {
+				t.Error("dnsCryptOpen() accepted a modified tag")
+			}
+		})
+	}
+}
+
+func TestDNSCryptSharedKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		esVersion uint16
+		want      string
+	}{
+		{
+			name:      "XSalsa20Poly1305",
+			esVersion: dnsCryptXSalsa20Poly1305,
+			want:      "582114e7de4fa92c89b08a28b000d6bb526263561e10300f2ad0eb068309765f",
+		},
+		{
+			name:      "XChacha20Poly1305",
+			esVersion: dnsCryptXChacha20Poly1305,
+			want:      "6464925c3a0aaa0011216d22902b9c58bafb013238b11f561cf060430198fc56",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sharedKey [32]byte
+			if err := dnsCryptSharedKey(test.esVersion, &sharedKey, &dnsCryptTestKey, &dnsCryptTestKey); err != nil {
+				t.Fatal(err)
+			}
+			if want := mustDecodeHex(t, test.want); !bytes.Equal(sharedKey[:], want) {
+				t.Errorf("dnsCryptSharedKey() = %x, want %x", sharedKey, want)
+			}
+		})
+	}
+}
+
+func TestDNSCryptUnpad(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		want    []byte
+		ok      bool
+	}{
+		{name: "padded", message: []byte{1, 2, 0x80, 0, 0}, want: []byte{1, 2}, ok: true},
+		{name: "only padding marker", message: []byte{1, 2, 0x80}, want: []byte{1, 2}, ok: true},
+		{name: "marker in message", message: []byte{0x80, 2, 0x80, 0}, want: []byte{0x80, 2}, ok: true},
+		{name: "no padding marker", message: []byte{1, 2, 0, 0}},
+		{name: "not zero after marker", message: []byte{1, 0x80, 0, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, ok := dnsCryptUnpad(test.message)
+			if ok != test.ok || !bytes.Equal(message, test.want) {
+				t.Errorf("dnsCryptUnpad(%x) = %x, %v, want %x, %v", test.message, message, ok, test.want, test.ok)
+			}
+		})
+	}
+}
@@ -9,11 +9,12 @@ import (
 // HostsDNSClient resolves DNS with Hosts
 type HostsDNSClient struct {
 	records map[string][]string
+	ttl     uint32
 }
 
 // NewHostsDNSClient returns a new hosts DNS client
-func NewHostsDNSClient(records map[string][]string) *HostsDNSClient {
-	return &HostsDNSClient{records: records}
+func NewHostsDNSClient(records map[string][]string, ttl uint32) *HostsDNSClient {
+	return &HostsDNSClient{records: records, ttl: ttl}
 }
 
 func (client *HostsDNSClient) String() string {
@@ -29,11 +30,17 @@ func (client *HostsDNSClient) FallbackNoECSEnabled() bool {
 }
 
 // Resolve DNS
-func (client *HostsDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS bool) (reply *dns.Msg, _ error) {
+func (client *HostsDNSClient) Resolve(request *dns.Msg, options ResolveOptions) (reply *dns.Msg, _ error) {
 	reply = getEmptyResponse(request)
 
 	question := request.Question[0]
 
+	// a domain name without any record does not exist
+	if len(client.records) == 0 {
+		SetNegativeAnswer(reply, dns.RcodeNameError, client.ttl)
+		return
+	}
+
 	var questionType string
 	var ok bool
 	if questionType, ok = dns.TypeToString[question.Qtype]; !ok {
@@ -43,14 +50,17 @@ func (client *HostsDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS
 
 	var records []string
 	if records, ok = client.records[questionType]; !ok {
-		reply.Answer = make([]dns.RR, 0)
-		return
+		if records, ok = client.records["CNAME"]; !ok {
+			SetNegativeAnswer(reply, dns.RcodeSuccess, client.ttl)
+			return
+		}
+		questionType = "CNAME"
 	}
 
 	reply.Answer = make([]dns.RR, len(records))
 
 	for index, record := range records {
-		zone := fmt.Sprintf("%s 0 IN %s %s", question.Name, questionType, record)
+		zone := fmt.Sprintf("%s %d IN %s %s", question.Name, client.ttl, questionType, record)
 		if rr, err := dns.NewRR(zone); err == nil {
 			reply.Answer[index] = rr
 		} else {
@@ -62,3 +72,19 @@ func (client *HostsDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS
 
 	return
 }
+
+// SetNegativeAnswer sets rcode of reply, with a synthesized SOA record in authority section for negative caching
+func SetNegativeAnswer(reply *dns.Msg, rcode int, ttl uint32) {
+	reply.Rcode = rcode
+	reply.Answer = make([]dns.RR, 0)
+	reply.Ns = []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: reply.Question[0].Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}}
+}
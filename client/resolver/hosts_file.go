@@ -0,0 +1,154 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+type hostsEntry struct {
+	ipv4 []net.IP
+	ipv6 []net.IP
+	ptr  []string
+}
+
+// HostsFileDNSClient resolves DNS with addresses of multiple domain names, such as hosts files,
+// PTR records are synthesized from the addresses
+type HostsFileDNSClient struct {
+	name string
+	ttl  uint32
+
+	mu      sync.RWMutex
+	entries map[string]*hostsEntry
+	names   []string
+	reverse []string
+}
+
+// NewHostsFileDNSClient returns a new hosts file DNS client
+func NewHostsFileDNSClient(name string, ttl uint32) *HostsFileDNSClient {
+	return &HostsFileDNSClient{name: name, ttl: ttl, entries: make(map[string]*hostsEntry)}
+}
+
+func (client *HostsFileDNSClient) String() string {
+	return client.name
+}
+
+func (client *HostsFileDNSClient) ECSDisabled() bool {
+	return true
+}
+
+func (client *HostsFileDNSClient) FallbackNoECSEnabled() bool {
+	return false
+}
+
+// Set addresses of domain names, replacing the old ones,
+// PTR records are answered in the order of names
+func (client *HostsFileDNSClient) Set(hostNames []string, hosts map[string][]net.IP) {
+	entries := make(map[string]*hostsEntry, len(hosts))
+	names := make([]string, 0, len(hosts))
+	reverse := make([]string, 0, len(hosts))
+
+	get := func(name string) *hostsEntry {
+		entry, ok := entries[name]
+		if !ok {
+			entry = &hostsEntry{}
+			entries[name] = entry
+		}
+		return entry
+	}
+
+	for _, hostName := range hostNames {
+		ips := hosts[hostName]
+		name := dns.Fqdn(strings.ToLower(hostName))
+		if _, ok := entries[name]; !ok {
+			names = append(names, name)
+		}
+		entry := get(name)
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				entry.ipv4 = append(entry.ipv4, ip4)
+			} else {
+				entry.ipv6 = append(entry.ipv6, ip)
+			}
+			reverseName, err := dns.ReverseAddr(ip.String())
+			if err != nil {
+				continue
+			}
+			if _, ok := entries[reverseName]; !ok {
+				reverse = append(reverse, reverseName)
+			}
+			ptr := get(reverseName)
+			if !containsName(ptr.ptr, name) {
+				ptr.ptr = append(ptr.ptr, name)
+			}
+		}
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.entries = entries
+	client.names = names
+	client.reverse = reverse
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns domain names with addresses
+func (client *HostsFileDNSClient) Names() []string {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	return client.names
+}
+
+// ReverseNames returns domain names of PTR records
+func (client *HostsFileDNSClient) ReverseNames() []string {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	return client.reverse
+}
+
+// Resolve DNS
+func (client *HostsFileDNSClient) Resolve(request *dns.Msg, options ResolveOptions) (reply *dns.Msg, _ error) {
+	reply = getEmptyResponse(request)
+
+	question := request.Question[0]
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: client.ttl}
+
+	client.mu.RLock()
+	entry, ok := client.entries[strings.ToLower(question.Name)]
+	client.mu.RUnlock()
+
+	if !ok {
+		SetNegativeAnswer(reply, dns.RcodeNameError, client.ttl)
+		return
+	}
+
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, ip := range entry.ipv4 {
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: header, A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range entry.ipv6 {
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	case dns.TypePTR:
+		for _, name := range entry.ptr {
+			reply.Answer = append(reply.Answer, &dns.PTR{Hdr: header, Ptr: name})
+		}
+	}
+
+	if len(reply.Answer) == 0 {
+		SetNegativeAnswer(reply, dns.RcodeSuccess, client.ttl)
+	}
+	return
+}
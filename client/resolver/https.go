@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"strings"
 	"time"
 
 	"github.com/jinliming2/secure-dns/client/ecs"
@@ -28,18 +29,24 @@ type HTTPSDNSClient struct {
 	timeout        time.Duration
 	singleInflight *singleflight.Group
 	logger         *zap.SugaredLogger
+	httpSettings   config.HTTPSettings
+	odoh           *odohTarget
 	config.DNSSettings
 }
 
-// NewHTTPSDNSClient returns a new HTTPS DNS client
+// NewHTTPSDNSClient returns a new HTTPS DNS client,
+// queries are sent to host through odohProxy with Oblivious DoH if odohProxy is not empty
 func NewHTTPSDNSClient(
 	host []string,
 	port uint16,
-	hostname, path string,
+	hostname, path, odohProxy string,
 	cookie bool,
 	timeout time.Duration,
 	settings config.DNSSettings,
-	bootstrap *net.Resolver,
+	httpSettings config.HTTPSettings,
+	tlsSettings config.TLSSettings,
+	clientCert *ClientCertificate,
+	bootstrap *Bootstrap,
 	logger *zap.SugaredLogger,
 ) (*HTTPSDNSClient, error) {
 
@@ -56,17 +63,27 @@ func NewHTTPSDNSClient(
 		}
 	}
 
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	dialer := &net.Dialer{
-		Resolver: bootstrap,
+	tlsConfig, err := newTLSConfig(hostname, tlsSettings, clientCert)
+	if err != nil {
+		return nil, err
 	}
-	transport.DialContext = dialer.DialContext
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = bootstrap.DialContext
+	transport.TLSClientConfig = tlsConfig
 
 	var jar http.CookieJar
 	if cookie {
 		jar, _ = cookiejar.New(nil)
 	}
 
+	var odoh *odohTarget
+	if odohProxy != "" {
+		if odoh, err = newODoHTarget(odohProxy, timeout, bootstrap); err != nil {
+			return nil, err
+		}
+	}
+
 	var sf *singleflight.Group
 	if !settings.NoSingleInflight {
 		sf = &singleflight.Group{}
@@ -85,16 +102,21 @@ func NewHTTPSDNSClient(
 		timeout:        timeout,
 		singleInflight: sf,
 		logger:         logger,
+		httpSettings:   httpSettings,
+		odoh:           odoh,
 		DNSSettings:    settings,
 	}, nil
 }
 
 func (client *HTTPSDNSClient) String() string {
+	if client.odoh != nil {
+		return fmt.Sprintf("odoh://%s:%d%s via %s", client.host, client.port, client.path, client.odoh.proxy)
+	}
 	return fmt.Sprintf("https://%s:%d%s", client.host, client.port, client.path)
 }
 
 func (client *HTTPSDNSClient) ECSDisabled() bool {
-	return client.NoECS
+	return client.NoECS || client.odoh != nil
 }
 
 func (client *HTTPSDNSClient) FallbackNoECSEnabled() bool {
@@ -102,12 +124,17 @@ func (client *HTTPSDNSClient) FallbackNoECSEnabled() bool {
 }
 
 // Resolve DNS
-func (client *HTTPSDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS bool) (*dns.Msg, error) {
-	return httpsSingleInflightRequest(request, forceNoECS, client.singleInflight, client.resolve)
+func (client *HTTPSDNSClient) Resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
+	return httpsSingleInflightRequest(request, options, client.singleInflight, client.resolve)
 }
 
-func (client *HTTPSDNSClient) resolve(request *dns.Msg, forceNoECS bool) (*dns.Msg, error) {
-	ecs.SetECS(request, forceNoECS || client.NoECS, client.CustomECS)
+func (client *HTTPSDNSClient) resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
+	if client.odoh != nil {
+		// EDNS Client Subnet would tell the target where the client is
+		ecs.RemoveECS(request)
+	} else {
+		setECS(request, &client.DNSSettings, options)
+	}
 
 	msg, err := request.Pack()
 	if err != nil {
@@ -116,10 +143,14 @@ func (client *HTTPSDNSClient) resolve(request *dns.Msg, forceNoECS bool) (*dns.M
 		return reply, err
 	}
 
-	data := base64.RawURLEncoding.EncodeToString(msg)
-
 	address := client.addresses[randomSource.Intn(len(client.addresses))]
 
+	if client.odoh != nil {
+		return client.resolveOblivious(request, msg, address)
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(msg)
+
 	url := fmt.Sprintf("https://%s%s?dns=%s", address.address, client.path, data)
 
 	var req *http.Request
@@ -144,32 +175,27 @@ func (client *HTTPSDNSClient) resolve(request *dns.Msg, forceNoECS bool) (*dns.M
 		req.Host = address.hostname
 	}
 
-	if client.NoUserAgent {
-		req.Header.Set("user-agent", "")
-	} else if client.UserAgent != "" {
-		req.Header.Set("user-agent", client.UserAgent)
-	} else {
-		req.Header.Set("user-agent", versions.USERAGENT)
-	}
+	setUserAgent(req, &client.DNSSettings)
+	setHTTPSettings(req, &client.httpSettings, options)
 
-	return httpsGetDNSMessage(request, req, client.client, address, client.path, client.logger)
+	return httpsGetDNSMessage(request, req, client.client, address, client.path, nil, client.logger)
 }
 
 func httpsSingleInflightRequest(
 	request *dns.Msg,
-	forceNoECS bool,
+	options ResolveOptions,
 	singleInflight *singleflight.Group,
-	resolve func(request *dns.Msg, forceNoECS bool) (*dns.Msg, error),
+	resolve func(request *dns.Msg, options ResolveOptions) (*dns.Msg, error),
 ) (*dns.Msg, error) {
 	if singleInflight == nil {
-		return resolve(request, forceNoECS)
+		return resolve(request, options)
 	}
 
 	question := request.Question[0]
-	key := fmt.Sprintf("%s:%d:%d", question.Name, question.Qtype, question.Qclass)
+	key := fmt.Sprintf("%s:%d:%d:%t:%v:%s", question.Name, question.Qtype, question.Qclass, options.ForceNoECS, options.CustomECS, options.ClientGroup)
 
 	result := <-singleInflight.DoChan(key, func() (interface{}, error) {
-		return resolve(request, forceNoECS)
+		return resolve(request, options)
 	})
 
 	if result.Err != nil || result.Val == nil {
@@ -185,12 +211,47 @@ func httpsSingleInflightRequest(
 	return reply, nil
 }
 
+// setUserAgent sets user-agent header of req
+func setUserAgent(req *http.Request, settings *config.DNSSettings) {
+	if settings.NoUserAgent {
+		req.Header.Set("user-agent", "")
+	} else if settings.UserAgent != "" {
+		req.Header.Set("user-agent", settings.UserAgent)
+	} else {
+		req.Header.Set("user-agent", versions.USERAGENT)
+	}
+}
+
+// setHTTPSettings sets extra headers and basic authentication of req, with {client_group} replaced
+func setHTTPSettings(req *http.Request, settings *config.HTTPSettings, options ResolveOptions) {
+	replacer := strings.NewReplacer("{client_group}", options.ClientGroup)
+	for key, value := range settings.Headers {
+		req.Header.Set(key, replacer.Replace(value))
+	}
+	if settings.Username != "" || settings.Password != "" {
+		req.SetBasicAuth(replacer.Replace(settings.Username), replacer.Replace(settings.Password))
+	}
+}
+
+// httpStatusError is returned if DNS over HTTPS server responds with a status code other than 2xx
+type httpStatusError struct {
+	address addressHostname
+	path    string
+	code    int
+	status  string
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP error from %s%s: %d %s", err.address, err.path, err.code, err.status)
+}
+
 func httpsGetDNSMessage(
 	request *dns.Msg,
 	req *http.Request,
 	client *http.Client,
 	address addressHostname,
 	path string,
+	query *odohQuery,
 	logger *zap.SugaredLogger,
 ) (*dns.Msg, error) {
 	res, err := client.Do(req)
@@ -202,10 +263,14 @@ func httpsGetDNSMessage(
 	}
 
 	if res.StatusCode >= 300 || res.StatusCode < 200 {
-		return getEmptyErrorResponse(request), fmt.Errorf("HTTP error from %s%s: %d %s", address, path, res.StatusCode, res.Status)
+		return getEmptyErrorResponse(request), &httpStatusError{address: address, path: path, code: res.StatusCode, status: res.Status}
 	}
 	contentType := res.Header.Get("content-type")
-	if !regexDNSMsg.MatchString(contentType) {
+	regexMIME := regexDNSMsg
+	if query != nil {
+		regexMIME = regexODoHMsg
+	}
+	if !regexMIME.MatchString(contentType) {
 		return getEmptyErrorResponse(request), fmt.Errorf("HTTP unsupported MIME type: %s", contentType)
 	}
 
@@ -215,6 +280,11 @@ func httpsGetDNSMessage(
 	if err != nil {
 		return getEmptyErrorResponse(request), err
 	}
+	if query != nil {
+		if body, err = query.openResponse(body); err != nil {
+			return getEmptyErrorResponse(request), err
+		}
+	}
 
 	reply := new(dns.Msg)
 	err = reply.Unpack(body)
@@ -9,9 +9,7 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/jinliming2/secure-dns/client/ecs"
 	"github.com/jinliming2/secure-dns/config"
-	"github.com/jinliming2/secure-dns/versions"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
@@ -27,6 +25,7 @@ type HTTPSGoogleDNSClient struct {
 	timeout        time.Duration
 	singleInflight *singleflight.Group
 	logger         *zap.SugaredLogger
+	httpSettings   config.HTTPSettings
 	config.DNSSettings
 }
 
@@ -38,7 +37,10 @@ func NewHTTPSGoogleDNSClient(
 	cookie bool,
 	timeout time.Duration,
 	settings config.DNSSettings,
-	bootstrap *net.Resolver,
+	httpSettings config.HTTPSettings,
+	tlsSettings config.TLSSettings,
+	clientCert *ClientCertificate,
+	bootstrap *Bootstrap,
 	logger *zap.SugaredLogger,
 ) (*HTTPSGoogleDNSClient, error) {
 
@@ -55,11 +57,14 @@ func NewHTTPSGoogleDNSClient(
 		}
 	}
 
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	dialer := &net.Dialer{
-		Resolver: bootstrap,
+	tlsConfig, err := newTLSConfig(hostname, tlsSettings, clientCert)
+	if err != nil {
+		return nil, err
 	}
-	transport.DialContext = dialer.DialContext
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = bootstrap.DialContext
+	transport.TLSClientConfig = tlsConfig
 
 	var jar http.CookieJar
 	if cookie {
@@ -84,6 +89,7 @@ func NewHTTPSGoogleDNSClient(
 		timeout:        timeout,
 		singleInflight: sf,
 		logger:         logger,
+		httpSettings:   httpSettings,
 		DNSSettings:    settings,
 	}, nil
 }
@@ -101,12 +107,12 @@ func (client *HTTPSGoogleDNSClient) FallbackNoECSEnabled() bool {
 }
 
 // Resolve DNS
-func (client *HTTPSGoogleDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS bool) (*dns.Msg, error) {
-	return httpsSingleInflightRequest(request, forceNoECS, client.singleInflight, client.resolve)
+func (client *HTTPSGoogleDNSClient) Resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
+	return httpsSingleInflightRequest(request, options, client.singleInflight, client.resolve)
 }
 
-func (client *HTTPSGoogleDNSClient) resolve(request *dns.Msg, forceNoECS bool) (*dns.Msg, error) {
-	ecs.SetECS(request, forceNoECS || client.NoECS, client.CustomECS)
+func (client *HTTPSGoogleDNSClient) resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
+	setECS(request, &client.DNSSettings, options)
 
 	query := url.Values{}
 	query.Set("name", request.Question[0].Name)
@@ -145,13 +151,8 @@ func (client *HTTPSGoogleDNSClient) resolve(request *dns.Msg, forceNoECS bool) (
 		req.Host = address.hostname
 	}
 
-	if client.NoUserAgent {
-		req.Header.Set("user-agent", "")
-	} else if client.UserAgent != "" {
-		req.Header.Set("user-agent", client.UserAgent)
-	} else {
-		req.Header.Set("user-agent", versions.USERAGENT)
-	}
+	setUserAgent(req, &client.DNSSettings)
+	setHTTPSettings(req, &client.httpSettings, options)
 
-	return httpsGetDNSMessage(request, req, client.client, address, client.path, client.logger)
+	return httpsGetDNSMessage(request, req, client.client, address, client.path, nil, client.logger)
 }
@@ -0,0 +1,150 @@
+package resolver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinliming2/secure-dns/config"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// newTestCertificate returns a self-signed certificate of hostname without ip addresses, and a CA file of it
+func newTestCertificate(t *testing.T, dir, hostname string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hostname},
+		DNSNames:              []string{hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// newTestDoHStamp returns a DoH stamp with both address and hostname
+func newTestDoHStamp(address, hostname, path string) string {
+	lp := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	data := []byte{byte(config.StampProtocolDoH)}
+	data = append(data, make([]byte, 8)...) // props
+	data = append(data, lp(address)...)
+	data = append(data, 0) // no hash
+	data = append(data, lp(hostname)...)
+	data = append(data, lp(path)...)
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestHTTPSStampServerName(t *testing.T) {
+	const hostname = "dns.example"
+
+	dir, err := ioutil.TempDir("", "secure-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certificate, caFile := newTestCertificate(t, dir, hostname)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS.ServerName != hostname || r.Host != hostname {
+			http.Error(w, fmt.Sprintf("server name %q, host %q", r.TLS.ServerName, r.Host), http.StatusBadRequest)
+			return
+		}
+		data, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		request := new(dns.Msg)
+		if err == nil {
+			err = request.Unpack(data)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reply := new(dns.Msg).SetReply(request)
+		rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A 192.0.2.1")
+		reply.Answer = append(reply.Answer, rr)
+		data, _ = reply.Pack()
+		w.Header().Set("content-type", mimeDNSMsg)
+		w.Write(data)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.toml")
+	upstream := newTestDoHStamp(serverURL.Host, hostname, "/dns-query") + "?ca_file=" + url.QueryEscape(caFile)
+	if err = ioutil.WriteFile(configFile, []byte(fmt.Sprintf("[config]\nlisten = ['127.0.0.1:53']\nupstreams = ['%s']\n", upstream)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.HTTPS) != 1 {
+		t.Fatalf("%d https upstreams, want 1", len(conf.HTTPS))
+	}
+	https := conf.HTTPS[0]
+	if https.Host[0] != "127.0.0.1" || https.Hostname != hostname {
+		t.Fatalf("host %v, hostname %q", https.Host, https.Hostname)
+	}
+
+	client, err := NewHTTPSDNSClient(
+		https.Host,
+		https.Port,
+		https.Hostname,
+		https.Path,
+		https.ODoHProxy,
+		https.Cookie,
+		5*time.Second,
+		https.DNSSettings,
+		https.HTTPSettings,
+		https.TLSSettings,
+		nil,
+		nil,
+		zap.NewNop().Sugar(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := client.Resolve(new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA), ResolveOptions{ForceNoECS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("answers %v, want 192.0.2.1", reply.Answer)
+	}
+}
@@ -0,0 +1,425 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE algorithms of ODoH configs, see RFC 9180 section 7
+const (
+	hpkeKEMX25519HKDFSHA256  uint16 = 0x0020
+	hpkeKDFHKDFSHA256        uint16 = 0x0001
+	hpkeAEADAES128GCM        uint16 = 0x0001
+	hpkeAEADAES256GCM        uint16 = 0x0002
+	hpkeAEADChaCha20Poly1305 uint16 = 0x0003
+)
+
+const (
+	odohVersion         uint16 = 0x0001
+	odohMessageQuery    byte   = 0x01
+	odohMessageResponse byte   = 0x02
+	odohConfigsPath            = "/.well-known/odohconfigs"
+	odohPaddingBlock           = 128
+	hpkeNonceSize              = 12
+	// configs are fetched again after odohConfigRefresh, in case of key rotation
+	odohConfigRefresh = time.Hour
+)
+
+// errODoHDecrypt is returned if the response can not be decrypted, the target may have rotated its key
+var errODoHDecrypt = errors.New("failed to decrypt ODoH response")
+
+// odohConfig is a supported ObliviousDoHConfig of the target, see RFC 9230 section 6.1
+type odohConfig struct {
+	aead      uint16
+	publicKey []byte
+	keyID     []byte
+	fetched   time.Time
+}
+
+// odohQuery is the context of an encrypted query, which is used to decrypt its response
+type odohQuery struct {
+	aead   uint16
+	plain  []byte
+	secret []byte
+}
+
+// odohTarget sends queries to an oblivious target through the oblivious proxy
+type odohTarget struct {
+	proxy  *url.URL
+	client *http.Client
+
+	mu     sync.Mutex
+	config *odohConfig
+}
+
+func newODoHTarget(proxy string, timeout time.Duration, bootstrap *Bootstrap) (*odohTarget, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid ODoH proxy: %s", proxy)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = bootstrap.DialContext
+
+	return &odohTarget{
+		proxy: u,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+	}, nil
+}
+
+// proxyURL returns URL of the proxy which forwards queries to targetHost and targetPath
+func (target *odohTarget) proxyURL(targetHost, targetPath string) string {
+	u := *target.proxy
+	query := u.Query()
+	query.Set("targethost", targetHost)
+	query.Set("targetpath", targetPath)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// getConfig returns the ODoH config of target, the old one is used if it can not be fetched again
+func (target *odohTarget) getConfig(client *http.Client, address addressHostname) (*odohConfig, error) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	if target.config != nil && time.Since(target.config.fetched) < odohConfigRefresh {
+		return target.config, nil
+	}
+
+	config, err := fetchODoHConfig(client, address)
+	if err != nil {
+		if target.config != nil {
+			return target.config, nil
+		}
+		return nil, err
+	}
+	target.config = config
+	return config, nil
+}
+
+// invalidate drops config, so that it will be fetched again by the next query
+func (target *odohTarget) invalidate(config *odohConfig) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	if target.config == config {
+		target.config = nil
+	}
+}
+
+func fetchODoHConfig(client *http.Client, address addressHostname) (*odohConfig, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s%s", address.address, odohConfigsPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if address.hostname != "" {
+		req.Host = address.hostname
+	}
+
+	res, err := client.Do(req)
+	if res != nil && res.Body != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 || res.StatusCode < 200 {
+		return nil, fmt.Errorf("HTTP error from %s%s: %d %s", address, odohConfigsPath, res.StatusCode, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseODoHConfigs(body)
+	if err != nil {
+		return nil, err
+	}
+	config.fetched = time.Now()
+	return config, nil
+}
+
+// parseODoHConfigs returns the first supported config of ObliviousDoHConfigs
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return nil, errors.New("invalid ODoH configs")
+	}
+	data = data[2 : 2+int(binary.BigEndian.Uint16(data))]
+
+	for len(data) >= 4 {
+		version := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, errors.New("invalid ODoH configs")
+		}
+		contents := data[4 : 4+length]
+		data = data[4+length:]
+
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		kem := binary.BigEndian.Uint16(contents)
+		kdf := binary.BigEndian.Uint16(contents[2:])
+		aead := binary.BigEndian.Uint16(contents[4:])
+		publicKey := contents[8:]
+		if kem != hpkeKEMX25519HKDFSHA256 || kdf != hpkeKDFHKDFSHA256 || hpkeAEADKeySize(aead) == 0 ||
+			int(binary.BigEndian.Uint16(contents[6:])) != len(publicKey) || len(publicKey) != curve25519.PointSize {
+			continue
+		}
+
+		return &odohConfig{
+			aead:      aead,
+			publicKey: publicKey,
+			keyID:     hkdfExpand(hkdf.Extract(sha256.New, contents, nil), []byte("odoh key id"), sha256.Size),
+		}, nil
+	}
+	return nil, errors.New("no supported ODoH config, only X25519, HKDF-SHA256 and AES-GCM or ChaCha20Poly1305 are supported")
+}
+
+// sealQuery encrypts DNS message to ObliviousDoHMessage of query with HPKE base mode, see RFC 9230 section 6.3
+func (config *odohConfig) sealQuery(msg []byte) ([]byte, *odohQuery, error) {
+	// ObliviousDoHMessagePlaintext, padded with zeros
+	padding := (odohPaddingBlock - len(msg)%odohPaddingBlock) % odohPaddingBlock
+	plain := make([]byte, 4+len(msg)+padding)
+	binary.BigEndian.PutUint16(plain, uint16(len(msg)))
+	copy(plain[2:], msg)
+	binary.BigEndian.PutUint16(plain[2+len(msg):], uint16(padding))
+
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(secretKey); err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, enc, err := hpkeEncap(secretKey, config.publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	hpke := newHPKEContext(config.aead, sharedSecret, []byte("odoh query"))
+
+	aead, err := newHPKEAEAD(config.aead, hpke.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := concat([]byte{odohMessageQuery}, lengthPrefixed(config.keyID))
+	encrypted := aead.Seal(enc, hpke.baseNonce, plain, aad)
+
+	query := &odohQuery{
+		aead:   config.aead,
+		plain:  plain,
+		secret: hpke.export([]byte("odoh response"), hpkeAEADKeySize(config.aead)),
+	}
+	return concat(aad, lengthPrefixed(encrypted)), query, nil
+}
+
+// openResponse decrypts ObliviousDoHMessage of response to DNS message, see RFC 9230 section 6.4
+func (query *odohQuery) openResponse(message []byte) ([]byte, error) {
+	if len(message) < 3 || message[0] != odohMessageResponse {
+		return nil, errors.New("invalid ODoH response")
+	}
+	nonceLength := int(binary.BigEndian.Uint16(message[1:]))
+	if len(message) < 5+nonceLength || len(message) != 5+nonceLength+int(binary.BigEndian.Uint16(message[3+nonceLength:])) {
+		return nil, errors.New("invalid ODoH response")
+	}
+	nonce := message[3 : 3+nonceLength]
+	encrypted := message[5+nonceLength:]
+
+	keySize := hpkeAEADKeySize(query.aead)
+	prk := hkdf.Extract(sha256.New, query.secret, concat(query.plain, lengthPrefixed(nonce)))
+	aead, err := newHPKEAEAD(query.aead, hkdfExpand(prk, []byte("odoh key"), keySize))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, hkdfExpand(prk, []byte("odoh nonce"), hpkeNonceSize), encrypted, concat([]byte{odohMessageResponse}, lengthPrefixed(nonce)))
+	if err != nil {
+		return nil, errODoHDecrypt
+	}
+
+	if len(plain) < 2 || len(plain) < 2+int(binary.BigEndian.Uint16(plain)) {
+		return nil, errors.New("invalid ODoH response")
+	}
+	return plain[2 : 2+int(binary.BigEndian.Uint16(plain))], nil
+}
+
+func (client *HTTPSDNSClient) resolveOblivious(request *dns.Msg, msg []byte, address addressHostname) (*dns.Msg, error) {
+	config, err := client.odoh.getConfig(client.client, address)
+	if err != nil {
+		return getEmptyErrorResponse(request), err
+	}
+	body, query, err := config.sealQuery(msg)
+	if err != nil {
+		return getEmptyErrorResponse(request), err
+	}
+
+	targetHost := address.address
+	if address.hostname != "" {
+		targetHost = fmt.Sprintf("%s:%d", address.hostname, client.port)
+	}
+	proxyURL := client.odoh.proxyURL(strings.TrimSuffix(targetHost, ":443"), client.path)
+
+	req, err := http.NewRequest(http.MethodPost, proxyURL, bytes.NewReader(body))
+	if err != nil {
+		return getEmptyErrorResponse(request), err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("content-type", mimeODoHMsg)
+	req.Header.Set("accept", mimeODoHMsg)
+	req.Close = false
+	client.logger.Debugf("[%d] POST %s with %d bytes body", request.Id, proxyURL, req.ContentLength)
+
+	// headers and basic authentication are not sent to the proxy
+	setUserAgent(req, &client.DNSSettings)
+
+	proxy := addressHostname{address: client.odoh.proxy.Host}
+	reply, err := httpsGetDNSMessage(request, req, client.odoh.client, proxy, client.odoh.proxy.Path, query, client.logger)
+	var statusErr *httpStatusError
+	if err == errODoHDecrypt || errors.As(err, &statusErr) && (statusErr.code == http.StatusBadRequest || statusErr.code == http.StatusUnauthorized) {
+		// the target may have rotated its key, which is rejected with 401 (RFC 9230 section 4.3) or 400 by some targets
+		client.odoh.invalidate(config)
+	}
+	return reply, err
+}
+
+// hpkeKEMSuite is suite_id of DHKEM(X25519, HKDF-SHA256)
+var hpkeKEMSuite = []byte{'K', 'E', 'M', byte(hpkeKEMX25519HKDFSHA256 >> 8), byte(hpkeKEMX25519HKDFSHA256)}
+
+// hpkeEncap is Encap of DHKEM(X25519, HKDF-SHA256) with the ephemeral secret key, returns shared secret and enc,
+// see RFC 9180 section 4.1
+func hpkeEncap(secretKey, publicKey []byte) ([]byte, []byte, error) {
+	enc, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(secretKey, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hpkeSharedSecret(dh, enc, publicKey), enc, nil
+}
+
+// hpkeSharedSecret is ExtractAndExpand of DHKEM(X25519, HKDF-SHA256)
+func hpkeSharedSecret(dh, enc, publicKey []byte) []byte {
+	return hpkeLabeledExpand(
+		hpkeKEMSuite,
+		hpkeLabeledExtract(hpkeKEMSuite, nil, "eae_prk", dh),
+		"shared_secret",
+		concat(enc, publicKey),
+		sha256.Size,
+	)
+}
+
+// hpkeContext is the encryption context of HPKE base mode, see RFC 9180 section 5.1
+type hpkeContext struct {
+	suite          []byte
+	key            []byte
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+// newHPKEContext is KeySchedule of HPKE base mode without psk, with DHKEM(X25519, HKDF-SHA256) and HKDF-SHA256
+func newHPKEContext(aead uint16, sharedSecret, info []byte) *hpkeContext {
+	suite := []byte{'H', 'P', 'K', 'E', 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(suite[4:], hpkeKEMX25519HKDFSHA256)
+	binary.BigEndian.PutUint16(suite[6:], hpkeKDFHKDFSHA256)
+	binary.BigEndian.PutUint16(suite[8:], aead)
+	context := concat(
+		[]byte{0},
+		hpkeLabeledExtract(suite, nil, "psk_id_hash", nil),
+		hpkeLabeledExtract(suite, nil, "info_hash", info),
+	)
+	secret := hpkeLabeledExtract(suite, sharedSecret, "secret", nil)
+	return &hpkeContext{
+		suite:          suite,
+		key:            hpkeLabeledExpand(suite, secret, "key", context, hpkeAEADKeySize(aead)),
+		baseNonce:      hpkeLabeledExpand(suite, secret, "base_nonce", context, hpkeNonceSize),
+		exporterSecret: hpkeLabeledExpand(suite, secret, "exp", context, sha256.Size),
+	}
+}
+
+// export is Context.Export of RFC 9180 section 5.3
+func (hpke *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(hpke.suite, hpke.exporterSecret, "sec", exporterContext, length)
+}
+
+// lengthPrefixed returns field prefixed with its length in 2 bytes
+func lengthPrefixed(field []byte) []byte {
+	prefixed := make([]byte, 2, 2+len(field))
+	binary.BigEndian.PutUint16(prefixed, uint16(len(field)))
+	return append(prefixed, field...)
+}
+
+// hpkeLabeledExtract is LabeledExtract of RFC 9180 section 4 with HKDF-SHA256
+func hpkeLabeledExtract(suite, salt []byte, label string, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, concat([]byte("HPKE-v1"), suite, []byte(label), ikm), salt)
+}
+
+// hpkeLabeledExpand is LabeledExpand of RFC 9180 section 4 with HKDF-SHA256
+func hpkeLabeledExpand(suite, prk []byte, label string, info []byte, length int) []byte {
+	return hkdfExpand(prk, concat([]byte{byte(length >> 8), byte(length)}, []byte("HPKE-v1"), suite, []byte(label), info), length)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	out := make([]byte, length)
+	// never fails for length less than 255 * sha256.Size
+	_, _ = io.ReadFull(hkdf.Expand(sha256.New, prk, info), out)
+	return out
+}
+
+// hpkeAEADKeySize returns key size of HPKE AEAD algorithm, 0 for unsupported algorithms
+func hpkeAEADKeySize(aead uint16) int {
+	switch aead {
+	case hpkeAEADAES128GCM:
+		return 16
+	case hpkeAEADAES256GCM, hpkeAEADChaCha20Poly1305:
+		return 32
+	}
+	return 0
+}
+
+func newHPKEAEAD(aead uint16, key []byte) (cipher.AEAD, error) {
+	switch aead {
+	case hpkeAEADAES128GCM, hpkeAEADAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case hpkeAEADChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unsupported HPKE AEAD: 0x%04x", aead)
+}
+
+func concat(slices ...[]byte) []byte {
+	var length int
+	for _, slice := range slices {
+		length += len(slice)
+	}
+	result := make([]byte, 0, length)
+	for _, slice := range slices {
+		result = append(result, slice...)
+	}
+	return result
+}
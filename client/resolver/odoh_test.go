@@ -0,0 +1,254 @@
+package resolver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// test vectors of RFC 9180 appendix A.1.1 and A.2.1, base mode of DHKEM(X25519, HKDF-SHA256) and HKDF-SHA256
+func TestHPKEBaseMode(t *testing.T) {
+	tests := []struct {
+		name           string
+		aead           uint16
+		skEm           string
+		pkRm           string
+		enc            string
+		sharedSecret   string
+		key            string
+		baseNonce      string
+		exporterSecret string
+		ct             string
+		exportedValue  string
+	}{
+		{
+			name:           "AES-128-GCM",
+			aead:           hpkeAEADAES128GCM,
+			skEm:           "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736",
+			pkRm:           "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d",
+			enc:            "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431",
+			sharedSecret:   "fe0e18c9f024ce43799ae393c7e8fe8fce9d218875e8227b0187c04e7d2ea1fc",
+			key:            "4531685d41d65f03dc48f6b8302c05b0",
+			baseNonce:      "56d890e5accaaf011cff4b7d",
+			exporterSecret: "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8",
+			ct:             "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a",
+			exportedValue:  "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee",
+		},
+		{
+			name:           "ChaCha20Poly1305",
+			aead:           hpkeAEADChaCha20Poly1305,
+			skEm:           "f4ec9b33b792c372c1d2c2063507b684ef925b8c75a42dbcbf57d63ccd381600",
+			pkRm:           "4310ee97d88cc1f088a5576c77ab0cf5c3ac797f3d95139c6c84b5429c59662a",
+			enc:            "1afa08d3dec047a643885163f1180476fa7ddb54c6a8029ea33f95796bf2ac4a",
+			sharedSecret:   "0bbe78490412b4bbea4812666f7916932b828bba79942424abb65244930d69a7",
+			key:            "ad2744de8e17f4ebba575b3f5f5a8fa1f69c2a07f6e7500bc60ca6e3e3ec1c91",
+			baseNonce:      "5c4d98150661b848853b547f",
+			exporterSecret: "a3b010d4994890e2c6968a36f64470d3c824c8f5029942feb11e7a74b2921922",
+			ct:             "1c5250d8034ec2b784ba2cfd69dbdb8af406cfe3ff938e131f0def8c8b60b4db21993c62ce81883d2dd1b51a28",
+			exportedValue:  "4bbd6243b8bb54cec311fac9df81841b6fd61f56538a775e7c80a9f40160606e",
+		},
+	}
+
+	info := []byte("Ode on a Grecian Urn")
+	aad := []byte("Count-0")
+	pt := []byte("Beauty is truth, truth beauty")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sharedSecret, enc, err := hpkeEncap(mustDecodeHex(t, test.skEm), mustDecodeHex(t, test.pkRm))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustDecodeHex(t, test.enc); !bytes.Equal(enc, want) {
+				t.Errorf("enc = %x, want %x", enc, want)
+			}
+			if want := mustDecodeHex(t, test.sharedSecret); !bytes.Equal(sharedSecret, want) {
+				t.Errorf("shared_secret = %x, want %x", sharedSecret, want)
+			}
+
+			hpke := newHPKEContext(test.aead, sharedSecret, info)
+			if want := mustDecodeHex(t, test.key); !bytes.Equal(hpke.key, want) {
+				t.Errorf("key = %x, want %x", hpke.key, want)
+			}
+			if want := mustDecodeHex(t, test.baseNonce); !bytes.Equal(hpke.baseNonce, want) {
+				t.Errorf("base_nonce = %x, want %x", hpke.baseNonce, want)
+			}
+			if want := mustDecodeHex(t, test.exporterSecret); !bytes.Equal(hpke.exporterSecret, want) {
+				t.Errorf("exporter_secret = %x, want %x", hpke.exporterSecret, want)
+			}
+
+			aead, err := newHPKEAEAD(test.aead, hpke.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct, want := aead.Seal(nil, hpke.baseNonce, pt, aad), mustDecodeHex(t, test.ct); !bytes.Equal(ct, want) {
+				t.Errorf("ct = %x, want %x", ct, want)
+			}
+			if exported, want := hpke.export(nil, 32), mustDecodeHex(t, test.exportedValue); !bytes.Equal(exported, want) {
+				t.Errorf("exported_value = %x, want %x", exported, want)
+			}
+		})
+	}
+}
+
+// test vectors of RFC 9230 appendix A
+const (
+	odohTestConfigs = "002c000100280020000100010020c6a793bedbd601c25970b1cc46bea80fdb1a8ec51540d79e4f9f17b8baa9da33"
+	odohTestSeed    = "c9d84d04e6369fccb8a4d5a264001491221f1b97d9b80dd32c35834bb4462383"
+	odohTestKeyID   = "9265d14d640ff991b31892f36326ab601ea84d61964fc7a9c7f981a5313e58b9"
+)
+
+// odohTestSecretKey derives the secret key of the target from seed, see DeriveKeyPair of RFC 9180 section 7.1.3
+func odohTestSecretKey(seed []byte) []byte {
+	prk := hpkeLabeledExtract(hpkeKEMSuite, nil, "dkp_prk", seed)
+	return hpkeLabeledExpand(hpkeKEMSuite, prk, "sk", nil, curve25519.ScalarSize)
+}
+
+// odohTestOpenQuery decrypts ObliviousDoHMessage of query as the target,
+// returns the plain text and the query context to decrypt the response
+func odohTestOpenQuery(t *testing.T, config *odohConfig, secretKey, message []byte) ([]byte, *odohQuery) {
+	t.Helper()
+	if len(message) < 3 || message[0] != odohMessageQuery {
+		t.Fatalf("invalid ODoH query: %x", message)
+	}
+	keyIDLength := int(binary.BigEndian.Uint16(message[1:]))
+	aad := message[:3+keyIDLength]
+	if keyID := aad[3:]; !bytes.Equal(keyID, config.keyID) {
+		t.Fatalf("key id = %x, want %x", keyID, config.keyID)
+	}
+	encrypted := message[5+keyIDLength:]
+	enc := encrypted[:curve25519.PointSize]
+
+	dh, err := curve25519.X25519(secretKey, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpke := newHPKEContext(config.aead, hpkeSharedSecret(dh, enc, config.publicKey), []byte("odoh query"))
+	aead, err := newHPKEAEAD(config.aead, hpke.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := aead.Open(nil, hpke.baseNonce, encrypted[curve25519.PointSize:], aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain, &odohQuery{
+		aead:   config.aead,
+		plain:  plain,
+		secret: hpke.export([]byte("odoh response"), hpkeAEADKeySize(config.aead)),
+	}
+}
+
+// odohTestConfig returns the config of RFC 9230 test vectors and the secret key of the target
+func odohTestConfig(t *testing.T) (*odohConfig, []byte) {
+	t.Helper()
+	config, err := parseODoHConfigs(mustDecodeHex(t, odohTestConfigs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey := odohTestSecretKey(mustDecodeHex(t, odohTestSeed))
+	publicKey, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(config.publicKey, publicKey) {
+		t.Fatalf("public key = %x, want %x", config.publicKey, publicKey)
+	}
+	return config, secretKey
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	config, _ := odohTestConfig(t)
+	if config.aead != hpkeAEADAES128GCM {
+		t.Errorf("aead = 0x%04x, want 0x%04x", config.aead, hpkeAEADAES128GCM)
+	}
+	if want := mustDecodeHex(t, odohTestKeyID); !bytes.Equal(config.keyID, want) {
+		t.Errorf("key id = %x, want %x", config.keyID, want)
+	}
+
+	if _, err := parseODoHConfigs(mustDecodeHex(t, "002c000200280020000100010020c6a793bedbd601c25970b1cc46bea80fdb1a8ec51540d79e4f9f17b8baa9da33")); err == nil {
+		t.Error("parseODoHConfigs() accepted an unsupported version")
+	}
+	if _, err := parseODoHConfigs(mustDecodeHex(t, "002c00010028")); err == nil {
+		t.Error("parseODoHConfigs() accepted truncated configs")
+	}
+}
+
+func TestODoHOpenResponse(t *testing.T) {
+	tests := []struct {
+		name              string
+		query             string
+		queryPadding      int
+		response          string
+		obliviousQuery    string
+		obliviousResponse string
+	}{
+		{
+			name:     "no padding",
+			query:    "9db1072b0ab473d1e4b74b09637d5f8f253ad4047426ab4dfcc58350bb67b60c",
+			response: "9db1072b0ab473d1e4b74b09637d5f8f253ad4047426ab4dfcc58350bb67b60c9db1072b0ab473d1e4b74b09637d5f8f253ad4047426ab4dfcc58350bb67b60c",
+			obliviousQuery: "0100209265d14d640ff991b31892f36326ab601ea84d61964fc7a9c7f981a5313e58b90054655d2fa2b2271e40b5a7" +
+				"8745e41e6d6c5c181fd1fcffcc30fc451d5ec7fdcc5a6ae0da1cba2bd379da93d02d0e42a3849ec6ba53a54c7c8216f0d3cc2c" +
+				"ef30ac54f824f5d8b57657d8c7b95e2c0276580b3851d9",
+			obliviousResponse: "0200100f474d14998a841b15f84388a8af1881005413556bcd8d86194fb47a51982b715b7f253f4f3ea14d89a5dd9d2b" +
+				"67e6c13b0b7eb7ae740c09d915ef77461956ba8acac5c5f1d8965ca0888b1c0aa2a0084b4c2c375b74e1c3d4e51ad3fe8080b7" +
+				"941fd5719df5",
+		},
+		{
+			name:         "padded",
+			query:        "6537c42600c6a3c6db735f8fb9e8e3618acf7508bb315a8862360c4b18dc83b8",
+			queryPadding: 32,
+			response:     "6537c42600c6a3c6db735f8fb9e8e3618acf7508bb315a8862360c4b18dc83b86537c42600c6a3c6db735f8fb9e8e3618acf7508bb315a8862360c4b18dc83b8",
+			obliviousQuery: "0100209265d14d640ff991b31892f36326ab601ea84d61964fc7a9c7f981a5313e58b90074e743c3dcfadd8b146103a6" +
+				"9f59544d25eeb7de64772910b4413c94c5716ae94743655e725a6d5e00e29e05fa812108b03d9913450b08b0ab04a7eeec65e1" +
+				"3ab52adcfac71b1ea280cbfd9c5865022835addc74f6f71d5c28358b121fae3150470324d4f4ecd0e49b729b74e525bed627e2" +
+				"668aa0",
+			obliviousResponse: "0200104463598990890a8bf9051685d6694597009499a1d75c78516db57ef3ffcfddc137ac801acf4a8632a1238ca4b2" +
+				"1facded26bc60fe132a1d44725f42fff07b11a10d00760592200c8aebd441a16b4902506c529a11e40af23634645e9d1be6432" +
+				"74a5ab65cf4fff9346f9a47cc752b885d242b65ebf62b6ace2ae6d8544cbe64310fcfdb85ad0272b142d6a39de262577bdd6c7" +
+				"b573ccb6e9f194c91e1034b40b57e10700a130",
+		},
+	}
+
+	config, secretKey := odohTestConfig(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := mustDecodeHex(t, test.query)
+			plain, query := odohTestOpenQuery(t, config, secretKey, mustDecodeHex(t, test.obliviousQuery))
+			if want := concat(lengthPrefixed(msg), lengthPrefixed(make([]byte, test.queryPadding))); !bytes.Equal(plain, want) {
+				t.Fatalf("query plain text = %x, want %x", plain, want)
+			}
+
+			response, err := query.openResponse(mustDecodeHex(t, test.obliviousResponse))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustDecodeHex(t, test.response); !bytes.Equal(response, want) {
+				t.Errorf("openResponse() = %x, want %x", response, want)
+			}
+
+			if _, err := query.openResponse(mustDecodeHex(t, test.obliviousQuery)); err == nil {
+				t.Error("openResponse() accepted a query")
+			}
+		})
+	}
+}
+
+func TestODoHSealQuery(t *testing.T) {
+	config, secretKey := odohTestConfig(t)
+	msg := mustDecodeHex(t, "9db1072b0ab473d1e4b74b09637d5f8f253ad4047426ab4dfcc58350bb67b60c")
+
+	message, query, err := config.sealQuery(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, target := odohTestOpenQuery(t, config, secretKey, message)
+	if want := concat(lengthPrefixed(msg), lengthPrefixed(make([]byte, odohPaddingBlock-len(msg)%odohPaddingBlock))); !bytes.Equal(plain, want) {
+		t.Errorf("query plain text = %x, want %x", plain, want)
+	}
+	if !bytes.Equal(query.plain, target.plain) || !bytes.Equal(query.secret, target.secret) {
+		t.Error("query context is different from the target")
+	}
+}
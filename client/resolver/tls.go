@@ -1,12 +1,12 @@
 package resolver
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"time"
 
-	"github.com/jinliming2/secure-dns/client/ecs"
 	"github.com/jinliming2/secure-dns/config"
 	"github.com/miekg/dns"
 )
@@ -16,7 +16,8 @@ type TLSDNSClient struct {
 	host      []string
 	port      uint16
 	addresses []string
-	client    *dns.Client
+	clients   []*dns.Client // client for each address
+	bootstrap *Bootstrap
 	timeout   time.Duration
 	config.DNSSettings
 }
@@ -28,34 +29,40 @@ func NewTLSDNSClient(
 	hostname string,
 	timeout time.Duration,
 	settings config.DNSSettings,
-	bootstrap *net.Resolver,
+	tlsSettings config.TLSSettings,
+	clientCert *ClientCertificate,
+	bootstrap *Bootstrap,
 ) (*TLSDNSClient, error) {
 
+	tlsConfig, err := newTLSConfig(hostname, tlsSettings, clientCert)
+	if err != nil {
+		return nil, err
+	}
+
 	addresses := make([]string, len(host))
+	clients := make([]*dns.Client, len(host))
 	for index, h := range host {
-		if ip := net.ParseIP(h); ip != nil && ip.To4() == nil {
-			addresses[index] = fmt.Sprintf("[%s]:%d", h, port)
-		} else {
-			addresses[index] = fmt.Sprintf("%s:%d", h, port)
+		addresses[index] = net.JoinHostPort(h, fmt.Sprint(port))
+		clientTLSConfig := tlsConfig
+		if hostname == "" {
+			// connections are dialed with resolved addresses, so that server name should be specified
+			clientTLSConfig = tlsConfig.Clone()
+			clientTLSConfig.ServerName = h
+		}
+		clients[index] = &dns.Client{
+			Net:            "tcp-tls",
+			TLSConfig:      clientTLSConfig,
+			Timeout:        timeout,
+			SingleInflight: !settings.NoSingleInflight,
 		}
 	}
 
 	return &TLSDNSClient{
-		host:      host,
-		port:      port,
-		addresses: addresses,
-		client: &dns.Client{
-			Net: "tcp-tls",
-			TLSConfig: &tls.Config{
-				ServerName:         hostname,
-				ClientSessionCache: tls.NewLRUClientSessionCache(-1),
-			},
-			Dialer: &net.Dialer{
-				Resolver: bootstrap,
-			},
-			Timeout:        timeout,
-			SingleInflight: !settings.NoSingleInflight,
-		},
+		host:        host,
+		port:        port,
+		addresses:   addresses,
+		clients:     clients,
+		bootstrap:   bootstrap,
 		timeout:     timeout,
 		DNSSettings: settings,
 	}, nil
@@ -74,9 +81,17 @@ func (client *TLSDNSClient) FallbackNoECSEnabled() bool {
 }
 
 // Resolve DNS
-func (client *TLSDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS bool) (*dns.Msg, error) {
-	ecs.SetECS(request, forceNoECS || client.NoECS, client.CustomECS)
-	res, _, err := client.client.Exchange(request, client.addresses[randomSource.Intn(len(client.addresses))])
+func (client *TLSDNSClient) Resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
+	setECS(request, &client.DNSSettings, options)
+	index := randomSource.Intn(len(client.addresses))
+	ctx, cancel := context.WithTimeout(context.Background(), client.timeout)
+	defer cancel()
+	conn, err := client.dial(ctx, index)
+	if err != nil {
+		return getEmptyErrorResponse(request), fmt.Errorf("failed to resolve %s using %s: %s", request.Question[0].Name, client.String(), err.Error())
+	}
+	defer conn.Close()
+	res, _, err := client.clients[index].ExchangeWithConn(request, conn)
 	if err != nil {
 		return getEmptyErrorResponse(request), fmt.Errorf("failed to resolve %s using %s: %s", request.Question[0].Name, client.String(), err.Error())
 	}
@@ -84,3 +99,20 @@ func (client *TLSDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS bo
 	res.Id = request.Id
 	return res, nil
 }
+
+// dial connects to the address of index with TLS, resolved addresses of host name are tried in order
+func (client *TLSDNSClient) dial(ctx context.Context, index int) (*dns.Conn, error) {
+	conn, err := client.bootstrap.DialContext(ctx, "tcp", client.addresses[index])
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, client.clients[index].TLSConfig)
+	// deadlines of reading and writing are set again by exchange
+	deadline, _ := ctx.Deadline()
+	tlsConn.SetDeadline(deadline)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
@@ -0,0 +1,103 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/jinliming2/secure-dns/config"
+)
+
+// newTLSConfig returns TLS config for DNS servers, which trusts CA in ca_file instead of system CA if specified,
+// and accepts only certificates matched spki_pin, cert_fingerprint or cert_tbs_hash if any of them specified.
+// serverName is verified instead of the host of address if specified, such as hostname of ip addresses.
+// clientCert is sent if the server requests a client certificate
+func newTLSConfig(serverName string, settings config.TLSSettings, clientCert *ClientCertificate) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(-1),
+	}
+
+	if clientCert != nil {
+		tlsConfig.GetClientCertificate = clientCert.getClientCertificate
+	}
+
+	if settings.CAFile != "" {
+		data, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(settings.SPKIPin)+len(settings.CertFingerprint)+len(settings.CertTBSHash) == 0 {
+		return tlsConfig, nil
+	}
+
+	spkiPins := make([][]byte, len(settings.SPKIPin))
+	for index, pin := range settings.SPKIPin {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki_pin: %s", pin)
+		}
+		spkiPins[index] = hash
+	}
+	fingerprints := make([][]byte, len(settings.CertFingerprint))
+	for index, fingerprint := range settings.CertFingerprint {
+		hash, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid cert_fingerprint: %s", fingerprint)
+		}
+		fingerprints[index] = hash
+	}
+	tbsHashes := make([][]byte, len(settings.CertTBSHash))
+	for index, tbsHash := range settings.CertTBSHash {
+		hash, err := hex.DecodeString(strings.ReplaceAll(tbsHash, ":", ""))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid cert_tbs_hash: %s", tbsHash)
+		}
+		tbsHashes[index] = hash
+	}
+
+	// called after certificates are verified with CA
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) > 0 {
+			hash := sha256.Sum256(rawCerts[0])
+			for _, fingerprint := range fingerprints {
+				if bytes.Equal(hash[:], fingerprint) {
+					return nil
+				}
+			}
+		}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range spkiPins {
+					if bytes.Equal(hash[:], pin) {
+						return nil
+					}
+				}
+				hash = sha256.Sum256(cert.RawTBSCertificate)
+				for _, tbsHash := range tbsHashes {
+					if bytes.Equal(hash[:], tbsHash) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("certificate of DNS server doesn't match any spki_pin, cert_fingerprint or cert_tbs_hash")
+	}
+
+	return tlsConfig, nil
+}
@@ -5,7 +5,6 @@ import (
 	"net"
 	"time"
 
-	"github.com/jinliming2/secure-dns/client/ecs"
 	"github.com/jinliming2/secure-dns/config"
 	"github.com/miekg/dns"
 )
@@ -64,14 +63,14 @@ func (client *TraditionalDNSClient) FallbackNoECSEnabled() bool {
 }
 
 // Resolve DNS
-func (client *TraditionalDNSClient) Resolve(request *dns.Msg, useTCP bool, forceNoECS bool) (*dns.Msg, error) {
+func (client *TraditionalDNSClient) Resolve(request *dns.Msg, options ResolveOptions) (*dns.Msg, error) {
 	var c *dns.Client
-	if useTCP {
+	if options.UseTCP {
 		c = client.tcpClient
 	} else {
 		c = client.udpClient
 	}
-	ecs.SetECS(request, forceNoECS || client.NoECS, client.CustomECS)
+	setECS(request, &client.DNSSettings, options)
 	res, _, err := c.Exchange(request, client.addresses[randomSource.Intn(len(client.addresses))])
 	if err != nil {
 		return getEmptyErrorResponse(request), fmt.Errorf("failed to resolve %s using %s: %s", request.Question[0].Name, client.String(), err.Error())
@@ -2,26 +2,41 @@ package resolver
 
 import (
 	"math/rand"
+	"net"
 	"regexp"
 	"time"
 
+	"github.com/jinliming2/secure-dns/client/ecs"
+	"github.com/jinliming2/secure-dns/config"
 	"github.com/miekg/dns"
 )
 
 var (
-	regexDNSMsg = regexp.MustCompile(`\bapplication/dns-message\b`)
+	regexDNSMsg  = regexp.MustCompile(`\bapplication/dns-message\b`)
+	regexODoHMsg = regexp.MustCompile(`\bapplication/oblivious-dns-message\b`)
 
-	mimeDNSMsg = "application/dns-message"
+	mimeDNSMsg  = "application/dns-message"
+	mimeODoHMsg = "application/oblivious-dns-message"
 
 	randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
 )
 
+// ResolveOptions are options of a single DNS request
+type ResolveOptions struct {
+	UseTCP     bool
+	ForceNoECS bool
+	// CustomECS overrides custom_ecs of DNS client if not empty
+	CustomECS []net.IP
+	// ClientGroup is name of client group of the request, empty if not in any group
+	ClientGroup string
+}
+
 // DNSClient is a DNS client
 type DNSClient interface {
 	String() string
 	ECSDisabled() bool
 	FallbackNoECSEnabled() bool
-	Resolve(*dns.Msg, bool, bool) (*dns.Msg, error)
+	Resolve(*dns.Msg, ResolveOptions) (*dns.Msg, error)
 }
 
 type addressHostname struct {
@@ -36,3 +51,12 @@ func getEmptyResponse(request *dns.Msg) *dns.Msg {
 func getEmptyErrorResponse(request *dns.Msg) *dns.Msg {
 	return new(dns.Msg).SetRcode(request, dns.RcodeServerFailure)
 }
+
+// setECS of request with settings of DNS client and options of this request
+func setECS(request *dns.Msg, settings *config.DNSSettings, options ResolveOptions) {
+	customECS := settings.CustomECS
+	if len(options.CustomECS) > 0 {
+		customECS = options.CustomECS
+	}
+	ecs.SetECS(request, options.ForceNoECS || settings.NoECS, customECS)
+}
@@ -0,0 +1,228 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// max number of CNAME records followed in a zone for one query
+const maxZoneCNAME = 8
+
+// ZoneDNSClient answers DNS authoritatively with records of a zone file
+type ZoneDNSClient struct {
+	origin string
+
+	mu sync.RWMutex
+	// records are keyed by lower case owner names and record types,
+	// empty non-terminals are stored with no record
+	records map[string]map[uint16][]dns.RR
+	soa     *dns.SOA
+}
+
+// NewZoneDNSClient returns a new DNS client of zone origin, records should be loaded with Load
+func NewZoneDNSClient(origin string) *ZoneDNSClient {
+	return &ZoneDNSClient{
+		origin:  dns.Fqdn(strings.ToLower(origin)),
+		records: make(map[string]map[uint16][]dns.RR),
+	}
+}
+
+func (client *ZoneDNSClient) String() string {
+	return "zone " + client.origin
+}
+
+func (client *ZoneDNSClient) ECSDisabled() bool {
+	return true
+}
+
+func (client *ZoneDNSClient) FallbackNoECSEnabled() bool {
+	return false
+}
+
+// Origin returns the origin of zone
+func (client *ZoneDNSClient) Origin() string {
+	return client.origin
+}
+
+// Load records from master file, replacing the old ones, and returns the number of records
+func (client *ZoneDNSClient) Load(fileName string) (int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	records := make(map[string]map[uint16][]dns.RR)
+	var soa *dns.SOA
+	count := 0
+
+	parser := dns.NewZoneParser(file, client.origin, fileName)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		header := rr.Header()
+		header.Name = strings.ToLower(header.Name)
+		if !dns.IsSubDomain(client.origin, header.Name) {
+			return 0, fmt.Errorf("%s: record out of zone %s: %s", fileName, client.origin, rr.String())
+		}
+		if record, ok := rr.(*dns.SOA); ok && header.Name == client.origin {
+			soa = record
+		}
+		rrSets, ok := records[header.Name]
+		if !ok {
+			rrSets = make(map[uint16][]dns.RR)
+			records[header.Name] = rrSets
+		}
+		rrSets[header.Rrtype] = append(rrSets[header.Rrtype], rr)
+		count++
+	}
+	if err := parser.Err(); err != nil {
+		return 0, err
+	}
+	if soa == nil {
+		return 0, errors.New(fileName + ": no SOA record of zone " + client.origin)
+	}
+
+	for name := range records {
+		for parent := parentName(name); parent != "" && dns.IsSubDomain(client.origin, parent); parent = parentName(parent) {
+			if _, ok := records[parent]; ok {
+				break
+			}
+			records[parent] = make(map[uint16][]dns.RR)
+		}
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.records = records
+	client.soa = soa
+	return count, nil
+}
+
+// Resolve DNS
+func (client *ZoneDNSClient) Resolve(request *dns.Msg, options ResolveOptions) (reply *dns.Msg, _ error) {
+	reply = getEmptyResponse(request)
+
+	question := request.Question[0]
+	name := strings.ToLower(question.Name)
+
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+
+	if client.soa == nil || !dns.IsSubDomain(client.origin, name) {
+		reply.Rcode = dns.RcodeRefused
+		return
+	}
+
+	// DS records are answered by the parent side of a zone cut
+	if cut := client.findCut(name); cut != "" && (cut != name || question.Qtype != dns.TypeDS) {
+		client.referral(reply, cut)
+		return
+	}
+
+	reply.Authoritative = true
+	client.answer(reply, question.Name, question.Qtype, maxZoneCNAME)
+	return
+}
+
+// findCut returns the topmost delegation of name, or empty string if name is not delegated
+func (client *ZoneDNSClient) findCut(name string) (cut string) {
+	for ; name != client.origin && name != ""; name = parentName(name) {
+		if len(client.records[name][dns.TypeNS]) > 0 {
+			cut = name
+		}
+	}
+	return
+}
+
+// referral sets NS records of cut in authority section, and glue records in additional section
+func (client *ZoneDNSClient) referral(reply *dns.Msg, cut string) {
+	for _, ns := range client.records[cut][dns.TypeNS] {
+		reply.Ns = append(reply.Ns, dns.Copy(ns))
+		target := strings.ToLower(ns.(*dns.NS).Ns)
+		for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			for _, glue := range client.records[target][qType] {
+				reply.Extra = append(reply.Extra, dns.Copy(glue))
+			}
+		}
+	}
+}
+
+// answer records of qName and qType, following CNAME records in zone at most depth times
+func (client *ZoneDNSClient) answer(reply *dns.Msg, qName string, qType uint16, depth int) {
+	name := strings.ToLower(qName)
+
+	rrSets, ok := client.records[name]
+	if !ok {
+		encloser := parentName(name)
+		for ; encloser != client.origin; encloser = parentName(encloser) {
+			if _, ok := client.records[encloser]; ok {
+				break
+			}
+		}
+		if rrSets, ok = client.records["*."+encloser]; !ok {
+			reply.Rcode = dns.RcodeNameError
+			reply.Ns = []dns.RR{client.negativeSOA()}
+			return
+		}
+	}
+
+	var records []dns.RR
+	if qType == dns.TypeANY {
+		for _, rrSet := range rrSets {
+			records = append(records, rrSet...)
+		}
+	} else {
+		records = rrSets[qType]
+	}
+
+	if len(records) == 0 && len(rrSets[dns.TypeCNAME]) > 0 {
+		cname := copyWithName(rrSets[dns.TypeCNAME][0], qName)
+		reply.Answer = append(reply.Answer, cname)
+		target := strings.ToLower(cname.(*dns.CNAME).Target)
+		if depth > 0 && dns.IsSubDomain(client.origin, target) && client.findCut(target) == "" {
+			client.answer(reply, target, qType, depth-1)
+		}
+		return
+	}
+
+	if len(records) == 0 {
+		reply.Ns = []dns.RR{client.negativeSOA()}
+		return
+	}
+
+	for _, rr := range records {
+		reply.Answer = append(reply.Answer, copyWithName(rr, qName))
+	}
+}
+
+// negativeSOA returns SOA record of zone for negative answers, with TTL of min(TTL, MINIMUM)
+func (client *ZoneDNSClient) negativeSOA() dns.RR {
+	soa := dns.Copy(client.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// copyWithName returns a copy of rr with owner name, for answering wildcard records and keeping case of the query
+func copyWithName(rr dns.RR, name string) dns.RR {
+	record := dns.Copy(rr)
+	record.Header().Name = name
+	return record
+}
+
+// parentName returns name without the first label, or empty string for the root
+func parentName(name string) string {
+	if name == "." {
+		return ""
+	}
+	dot := strings.IndexByte(name, '.')
+	if dot < 0 || dot == len(name)-1 {
+		return "."
+	}
+	return name[dot+1:]
+}
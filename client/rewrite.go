@@ -0,0 +1,174 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jinliming2/secure-dns/client/matcher"
+	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/miekg/dns"
+)
+
+// max number of cname rewrites followed for one query
+const maxRewriteDepth = 8
+
+type rewriteRule struct {
+	condition string
+	cname     string
+	alias     bool
+	ipv4      []net.IP
+	ipv6      []net.IP
+
+	svcbPolicy   *string // nil to use policy of client group or global
+	svcbStripECH *bool
+}
+
+func (rule *rewriteRule) String() string {
+	actions := make([]string, 0, 3)
+	if rule.alias {
+		actions = append(actions, "alias "+rule.cname)
+	} else if rule.cname != "" {
+		actions = append(actions, "cname "+rule.cname)
+	}
+	if len(rule.ipv4) > 0 {
+		actions = append(actions, fmt.Sprintf("ipv4 %v", rule.ipv4))
+	}
+	if len(rule.ipv6) > 0 {
+		actions = append(actions, fmt.Sprintf("ipv6 %v", rule.ipv6))
+	}
+	return strings.Join(actions, ", ")
+}
+
+// addRewrite adds a rewrite rule which is applied to domain names matched by rule
+func (client *Client) addRewrite(rewrite *rewriteRule, rule matcher.Rule) error {
+	for _, group := range rule.ClientGroup {
+		if !client.hasClientGroup(group) {
+			return fmt.Errorf("no such client group: %s", group)
+		}
+	}
+	if rewrite.cname != "" {
+		rewrite.cname = dns.Fqdn(strings.ToLower(rewrite.cname))
+	}
+	rewrite.condition = rule.String()
+	if err := client.rewriteMatcher.Set(len(client.rewrites), rule); err != nil {
+		return err
+	}
+	client.rewrites = append(client.rewrites, rewrite)
+	return nil
+}
+
+// matchRewrite returns the best rewrite rule that matches domain, qType and group, or nil if no one matched
+func (client *Client) matchRewrite(domain string, qType uint16, group *clientGroup) *rewriteRule {
+	groupName := ""
+	if group != nil {
+		groupName = group.name
+	}
+	if index := client.rewriteMatcher.Match(domain, qType, groupName); index >= 0 {
+		return client.rewrites[index]
+	}
+	return nil
+}
+
+// resolveRewrite resolves r with rewrite rules, cname rewrites are followed at most depth times
+func (client *Client) resolveRewrite(r *dns.Msg, group *clientGroup, options resolver.ResolveOptions, depth int) (*dns.Msg, answerPolicy, error) {
+	question := r.Question[0]
+
+	rule := client.matchRewrite(question.Name, question.Qtype, group)
+	if rule == nil {
+		return client.route(r, group, options)
+	}
+	client.logger.Debugf("[%d] rewriting %s: %s", r.Id, question.Name, rule.String())
+
+	if rule.cname == "" {
+		response, policy, err := client.route(r, group, options)
+		rule.replaceAddress(response)
+		return response, rule.override(policy), err
+	}
+
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: question.Qclass},
+		Target: rule.cname,
+	}
+	if question.Qtype == dns.TypeCNAME && !rule.alias {
+		response := new(dns.Msg).SetReply(r)
+		response.Answer = []dns.RR{cname}
+		return response, rule.override(client.policy(group)), nil
+	}
+
+	if depth <= 0 {
+		client.logger.Warnf("too many rewrites for %s", question.Name)
+		return new(dns.Msg).SetRcode(r, dns.RcodeServerFailure), client.policy(group), fmt.Errorf("too many rewrites for %s", question.Name)
+	}
+
+	request := r.Copy()
+	request.Question[0].Name = rule.cname
+	response, policy, err := client.resolveRewrite(request, group, options, depth-1)
+	response.Question = []dns.Question{question}
+	// options of the rule matching the query name take precedence over rules matching the cname
+	policy = rule.override(policy)
+	if err != nil {
+		return response, policy, err
+	}
+
+	if rule.alias {
+		for _, answer := range response.Answer {
+			if header := answer.Header(); strings.EqualFold(header.Name, rule.cname) {
+				header.Name = question.Name
+			}
+		}
+	} else {
+		for index, answer := range response.Answer {
+			if ttl := answer.Header().Ttl; index == 0 || ttl < cname.Hdr.Ttl {
+				cname.Hdr.Ttl = ttl
+			}
+		}
+		response.Answer = append([]dns.RR{cname}, response.Answer...)
+	}
+
+	rule.replaceAddress(response)
+	return response, policy, err
+}
+
+// override returns a copy of policy with options specified by rule
+func (rule *rewriteRule) override(policy answerPolicy) answerPolicy {
+	policy.svcb = policy.svcb.override(rule.svcbPolicy, rule.svcbStripECH)
+	return policy
+}
+
+// replaceAddress replaces addresses of A and AAAA records in response, keeping TTL of the original records
+func (rule *rewriteRule) replaceAddress(response *dns.Msg) {
+	if len(rule.ipv4)+len(rule.ipv6) == 0 || response.Rcode != dns.RcodeSuccess {
+		return
+	}
+	answers := make([]dns.RR, 0, len(response.Answer))
+	replacedA, replacedAAAA := false, false
+	for _, answer := range response.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			if len(rule.ipv4) == 0 {
+				break
+			}
+			if !replacedA {
+				for _, ip := range rule.ipv4 {
+					answers = append(answers, &dns.A{Hdr: rr.Hdr, A: ip})
+				}
+				replacedA = true
+			}
+			continue
+		case *dns.AAAA:
+			if len(rule.ipv6) == 0 {
+				break
+			}
+			if !replacedAAAA {
+				for _, ip := range rule.ipv6 {
+					answers = append(answers, &dns.AAAA{Hdr: rr.Hdr, AAAA: ip})
+				}
+				replacedAAAA = true
+			}
+			continue
+		}
+		answers = append(answers, answer)
+	}
+	response.Answer = answers
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"net"
+	"strings"
+
+	"github.com/jinliming2/secure-dns/client/resolver"
+	"github.com/jinliming2/secure-dns/config"
+	"github.com/miekg/dns"
+)
+
+// svcbPolicy controls HTTPS and SVCB answers
+type svcbPolicy struct {
+	// policy is one of config.SVCBPolicyKeep, SVCBPolicyDrop, SVCBPolicyStripHints and SVCBPolicyRewriteHints
+	policy string
+	// stripECH removes ech parameter
+	stripECH bool
+}
+
+// override returns a copy of policy with specified options
+func (policy svcbPolicy) override(svcb *string, stripECH *bool) svcbPolicy {
+	if svcb != nil {
+		policy.policy = *svcb
+	}
+	if stripECH != nil {
+		policy.stripECH = *stripECH
+	}
+	return policy
+}
+
+// filterSVCB applies policy to HTTPS and SVCB records in response
+func (client *Client) filterSVCB(response *dns.Msg, group *clientGroup, policy svcbPolicy) {
+	if policy.policy == config.SVCBPolicyKeep && !policy.stripECH {
+		return
+	}
+
+	answers := response.Answer[:0]
+	for _, answer := range response.Answer {
+		var svcb *dns.SVCB
+		switch rr := answer.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			answers = append(answers, answer)
+			continue
+		}
+		if policy.policy == config.SVCBPolicyDrop {
+			continue
+		}
+
+		target := svcb.Target
+		if target == "." {
+			target = svcb.Hdr.Name
+		}
+		var ipv4Hint, ipv6Hint []net.IP
+		var overrideIPv4, overrideIPv6 bool
+		if policy.policy == config.SVCBPolicyRewriteHints {
+			ipv4Hint, overrideIPv4 = client.overriddenAddresses(target, dns.TypeA, group, maxRewriteDepth)
+			ipv6Hint, overrideIPv6 = client.overriddenAddresses(target, dns.TypeAAAA, group, maxRewriteDepth)
+		}
+
+		values := make([]dns.SVCBKeyValue, 0, len(svcb.Value)+2)
+		for _, value := range svcb.Value {
+			switch value.(type) {
+			case *dns.SVCBIPv4Hint:
+				if policy.policy == config.SVCBPolicyStripHints || overrideIPv4 {
+					continue
+				}
+			case *dns.SVCBIPv6Hint:
+				if policy.policy == config.SVCBPolicyStripHints || overrideIPv6 {
+					continue
+				}
+			case *dns.SVCBECHConfig:
+				if policy.stripECH {
+					continue
+				}
+			}
+			values = append(values, value)
+		}
+		// only service mode records (priority > 0) have parameters
+		if svcb.Priority > 0 {
+			if len(ipv4Hint) > 0 {
+				values = append(values, &dns.SVCBIPv4Hint{Hint: ipv4Hint})
+			}
+			if len(ipv6Hint) > 0 {
+				values = append(values, &dns.SVCBIPv6Hint{Hint: ipv6Hint})
+			}
+		}
+		svcb.Value = values
+		answers = append(answers, answer)
+	}
+	response.Answer = answers
+}
+
+// overriddenAddresses returns addresses of name if A or AAAA records of name are answered by rewrite rules or hosts,
+// cname rewrites are followed at most depth times
+func (client *Client) overriddenAddresses(name string, qType uint16, group *clientGroup, depth int) ([]net.IP, bool) {
+	if rule := client.matchRewrite(name, qType, group); rule != nil {
+		if qType == dns.TypeA && len(rule.ipv4) > 0 {
+			return rule.ipv4, true
+		}
+		if qType == dns.TypeAAAA && len(rule.ipv6) > 0 {
+			return rule.ipv6, true
+		}
+		if rule.cname != "" {
+			if depth <= 0 {
+				return nil, false
+			}
+			return client.overriddenAddresses(rule.cname, qType, group, depth-1)
+		}
+	}
+
+	custom := client.matchCustomResolver(name, qType, group)
+	if custom == nil || !isLocal(custom.resolver) {
+		return nil, false
+	}
+	request := new(dns.Msg).SetQuestion(dns.Fqdn(strings.ToLower(name)), qType)
+	response, err := custom.resolver.Resolve(request, resolver.ResolveOptions{})
+	if err != nil {
+		return nil, false
+	}
+	var addresses []net.IP
+	for _, answer := range response.Answer {
+		if ip := answerIP(answer); ip != nil {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses, true
+}
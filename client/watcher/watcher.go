@@ -0,0 +1,126 @@
+package watcher
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// delay before calling handlers, so that multiple events caused by one save are merged
+const debounce = 500 * time.Millisecond
+
+// Watcher watches files and calls handlers after they are changed
+type Watcher struct {
+	logger  *zap.SugaredLogger
+	watcher *fsnotify.Watcher
+
+	mu       sync.Mutex
+	handlers map[string][]func()
+	timers   map[string]*time.Timer
+	dirs     map[string]bool
+}
+
+// NewWatcher returns a new file watcher
+func NewWatcher(logger *zap.SugaredLogger) (*Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	watcher := &Watcher{
+		logger:   logger,
+		watcher:  w,
+		handlers: make(map[string][]func()),
+		timers:   make(map[string]*time.Timer),
+		dirs:     make(map[string]bool),
+	}
+
+	go watcher.run()
+
+	return watcher, nil
+}
+
+// Add a handler which will be called after file changed
+func (watcher *Watcher) Add(file string, handler func()) error {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	// watch the directory instead of the file itself,
+	// editors usually save files by writing a new file and renaming it to the original one
+	dir := filepath.Dir(file)
+	if !watcher.dirs[dir] {
+		if err := watcher.watcher.Add(dir); err != nil {
+			return err
+		}
+		watcher.dirs[dir] = true
+	}
+
+	watcher.handlers[file] = append(watcher.handlers[file], handler)
+	return nil
+}
+
+// Close the watcher
+func (watcher *Watcher) Close() error {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	for file, timer := range watcher.timers {
+		timer.Stop()
+		delete(watcher.timers, file)
+	}
+	return watcher.watcher.Close()
+}
+
+func (watcher *Watcher) run() {
+	for {
+		select {
+		case event, ok := <-watcher.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			watcher.trigger(filepath.Clean(event.Name))
+		case err, ok := <-watcher.watcher.Errors:
+			if !ok {
+				return
+			}
+			watcher.logger.Warnf("file watcher error: %s", err.Error())
+		}
+	}
+}
+
+func (watcher *Watcher) trigger(file string) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	handlers, ok := watcher.handlers[file]
+	if !ok {
+		return
+	}
+
+	if timer, ok := watcher.timers[file]; ok {
+		timer.Reset(debounce)
+		return
+	}
+
+	watcher.timers[file] = time.AfterFunc(debounce, func() {
+		watcher.mu.Lock()
+		delete(watcher.timers, file)
+		watcher.mu.Unlock()
+
+		watcher.logger.Infof("file changed: %s", file)
+		for _, handler := range handlers {
+			handler()
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"github.com/jinliming2/secure-dns/client/matcher"
+	"github.com/jinliming2/secure-dns/client/resolver"
+)
+
+// addZone adds an authoritative zone loaded from fileName
+func (client *Client) addZone(origin, fileName string) error {
+	zone := resolver.NewZoneDNSClient(origin)
+	count, err := zone.Load(fileName)
+	if err != nil {
+		return err
+	}
+	client.logger.Debugf("new zone: %s, %d record(s) from file %s", zone.Origin(), count, fileName)
+
+	if err := client.zoneMatcher.Set(len(client.zones), matcher.Rule{Suffix: []string{zone.Origin()}}); err != nil {
+		return err
+	}
+	client.zones = append(client.zones, zone)
+
+	if client.watcher == nil {
+		return nil
+	}
+	return client.watcher.Add(fileName, func() {
+		count, err := zone.Load(fileName)
+		if err != nil {
+			client.logger.Warnf("failed to reload %s: %s", fileName, err.Error())
+			return
+		}
+		if client.cacher != nil {
+			client.cacher.Clear()
+		}
+		client.logger.Infof("reloaded %d record(s) of zone %s from file %s", count, zone.Origin(), fileName)
+	})
+}
+
+// matchZone returns the most specific zone contains domain, or nil if no one matched
+func (client *Client) matchZone(domain string) *resolver.ZoneDNSClient {
+	if index := client.zoneMatcher.Match(domain, 0, ""); index >= 0 {
+		return client.zones[index]
+	}
+	return nil
+}
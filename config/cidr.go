@@ -0,0 +1,53 @@
+package config
+
+import (
+	"net"
+	"strings"
+)
+
+// CIDR is an IP network, a single IP address is treated as a network with full mask
+type CIDR struct {
+	net.IPNet
+}
+
+// UnmarshalText parses CIDR notation or IP address
+func (cidr *CIDR) UnmarshalText(text []byte) error {
+	str := string(text)
+	if !strings.Contains(str, "/") {
+		if ip := net.ParseIP(str); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				str += "/32"
+			} else {
+				str += "/128"
+			}
+		}
+	}
+	_, network, err := net.ParseCIDR(str)
+	if err != nil {
+		return err
+	}
+	cidr.IPNet = *network
+	return nil
+}
+
+func (cidr CIDR) String() string {
+	return cidr.IPNet.String()
+}
+
+// MarshalText returns CIDR notation
+func (cidr CIDR) MarshalText() ([]byte, error) {
+	return []byte(cidr.String()), nil
+}
+
+// CIDRList is a list of IP networks
+type CIDRList []CIDR
+
+// Contains reports whether ip is in any network of the list
+func (list CIDRList) Contains(ip net.IP) bool {
+	for _, cidr := range list {
+		if cidr.IPNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,9 +2,33 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"path/filepath"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/jinliming2/secure-dns/client/matcher"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DenyActionRefuse answers denied clients with REFUSED
+	DenyActionRefuse = "refuse"
+	// DenyActionDrop drops requests of denied clients
+	DenyActionDrop = "drop"
+)
+
+const (
+	// SVCBPolicyKeep answers HTTPS and SVCB records as is
+	SVCBPolicyKeep = "keep"
+	// SVCBPolicyDrop removes HTTPS and SVCB records from answers
+	SVCBPolicyDrop = "drop"
+	// SVCBPolicyStripHints removes ipv4hint and ipv6hint of HTTPS and SVCB records
+	SVCBPolicyStripHints = "strip_hints"
+	// SVCBPolicyRewriteHints replaces ipv4hint and ipv6hint of HTTPS and SVCB records
+	// with addresses of hosts and rewrite rules, if the target name is overridden by them
+	SVCBPolicyRewriteHints = "rewrite_hints"
 )
 
 // DNSSettings described general settings of DNS resolver
@@ -17,37 +41,158 @@ type DNSSettings struct {
 	NoSingleInflight bool     `toml:"no_single_inflight"`
 }
 
+// TLSSettings described how to verify certificates of DNS over TLS and DNS over HTTPS servers
+type TLSSettings struct {
+	SPKIPin         []string `toml:"spki_pin"`         // base64 encoded SHA-256 of subject public key info
+	CertFingerprint []string `toml:"cert_fingerprint"` // hex encoded SHA-256 of certificate
+	CertTBSHash     []string `toml:"cert_tbs_hash"`    // hex encoded SHA-256 of to-be-signed part of certificate, used by DNS stamps
+	CAFile          string   `toml:"ca_file"`
+	ClientCert      string   `toml:"client_cert"`
+	ClientKey       string   `toml:"client_key"`
+}
+
+// HTTPSettings described extra HTTP headers and authentication of DNS over HTTPS requests,
+// {client_group} in them is replaced with the client group name of the request
+type HTTPSettings struct {
+	Headers  map[string]string `toml:"headers"`
+	Username string            `toml:"username"`
+	Password string            `toml:"password"`
+}
+
+// AnswerPolicy described how answers of queries matched by a rule are filtered
+type AnswerPolicy struct {
+	DisableAAAA  *bool   `toml:"disable_aaaa"`   // default: disable_aaaa of client group or [config]
+	PreferIPv4   *bool   `toml:"prefer_ipv4"`    // default: prefer_ipv4 of client group or [config]
+	SVCBPolicy   *string `toml:"svcb_policy"`    // default: svcb_policy of client group or [config]
+	SVCBStripECH *bool   `toml:"svcb_strip_ech"` // default: svcb_strip_ech of client group or [config]
+}
+
 type typeCustomSpecified struct {
-	Domain []string `toml:"domain"`
-	Suffix []string `toml:"suffix"`
+	Domain      []string `toml:"domain"`
+	Suffix      []string `toml:"suffix"`
+	Regex       []string `toml:"regex"`
+	Keyword     []string `toml:"keyword"`
+	QType       []string `toml:"qtype"`
+	ClientGroup []string `toml:"client_group"`
+	Priority    int32    `toml:"priority"`
+	AnswerPolicy
+}
+
+// CustomSpecified returns true if any domain condition is specified
+func (custom *typeCustomSpecified) CustomSpecified() bool {
+	return len(custom.Domain)+len(custom.Suffix)+len(custom.Regex)+len(custom.Keyword)+len(custom.QType)+len(custom.ClientGroup) > 0
+}
+
+// DomainSpecified returns true if any domain name condition is specified,
+// qtype and client_group only filter the queries
+func (custom *typeCustomSpecified) DomainSpecified() bool {
+	return len(custom.Domain)+len(custom.Suffix)+len(custom.Regex)+len(custom.Keyword) > 0
+}
+
+// qTypes returns query types specified in qtype
+func (custom *typeCustomSpecified) qTypes() ([]uint16, error) {
+	qTypes := make([]uint16, len(custom.QType))
+	for index, t := range custom.QType {
+		qType, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type: %s", t)
+		}
+		qTypes[index] = qType
+	}
+	return qTypes, nil
+}
+
+// Rule returns the matching rule of conditions
+func (custom *typeCustomSpecified) Rule() (matcher.Rule, error) {
+	qTypes, err := custom.qTypes()
+	if err != nil {
+		return matcher.Rule{}, err
+	}
+	return matcher.Rule{
+		Domain:      custom.Domain,
+		Suffix:      custom.Suffix,
+		Regex:       custom.Regex,
+		Keyword:     custom.Keyword,
+		QType:       qTypes,
+		ClientGroup: custom.ClientGroup,
+		Priority:    custom.Priority,
+	}, nil
 }
 
 type typeGeneralConfig struct {
-	Listen        []string  `toml:"listen"`
-	Timeout       *uint     `toml:"timeout"`     // seconds
-	RoundRobin    Selectors `toml:"round_robin"` // default: clock
-	CacheNoAnswer uint32    `toml:"cache_no_answer"`
-	NoCache       bool      `toml:"no_cache"`
+	Listen               []string  `toml:"listen"`
+	Timeout              *uint     `toml:"timeout"`           // seconds
+	RoundRobin           Selectors `toml:"round_robin"`       // default: clock
+	BootstrapRefresh     *uint     `toml:"bootstrap_refresh"` // seconds, default: 3600
+	Upstreams            []string  `toml:"upstreams"`
+	CacheNoAnswer        uint32    `toml:"cache_no_answer"`
+	NoCache              bool      `toml:"no_cache"`
+	HostsTTL             *uint32   `toml:"hosts_ttl"` // default: 60
+	HostsFile            []string  `toml:"hosts_file"`
+	WatchFiles           bool      `toml:"watch_files"`
+	Allow                CIDRList  `toml:"allow"`
+	Deny                 CIDRList  `toml:"deny"`
+	DenyAction           string    `toml:"deny_action"`            // default: refuse
+	RateLimit            uint      `toml:"rate_limit"`             // queries per second
+	RateLimitBurst       uint      `toml:"rate_limit_burst"`       // default: rate_limit
+	RateLimitSlip        *uint     `toml:"rate_limit_slip"`        // default: 2
+	RateLimitIPv4Prefix  int       `toml:"rate_limit_ipv4_prefix"` // default: 32
+	RateLimitIPv6Prefix  int       `toml:"rate_limit_ipv6_prefix"` // default: 56
+	FallbackTag          string    `toml:"fallback_tag"`
+	FallbackExpectIP     CIDRList  `toml:"fallback_expect_ip"`
+	FallbackExpectIPFile string    `toml:"fallback_expect_ip_file"`
+	FallbackBogusIP      CIDRList  `toml:"fallback_bogus_ip"`
+	BogusNXDomain        CIDRList  `toml:"bogus_nxdomain"`
+	BlockAnswerIP        CIDRList  `toml:"block_answer_ip"`
+	RebindProtection     bool      `toml:"rebind_protection"`
+	RebindAllow          []string  `toml:"rebind_allow"`
+	DisableAAAA          bool      `toml:"disable_aaaa"`
+	PreferIPv4           bool      `toml:"prefer_ipv4"`
+	SVCBPolicy           string    `toml:"svcb_policy"` // default: keep
+	SVCBStripECH         bool      `toml:"svcb_strip_ech"`
+	DNS64                bool      `toml:"dns64"`
+	DNS64Prefix          *CIDR     `toml:"dns64_prefix"` // default: 64:ff9b::/96
+	DNS64Exclude         CIDRList  `toml:"dns64_exclude"`
 	DNSSettings
 }
 
 type typeUpstreamHTTPS struct {
-	Host     []string `toml:"host"`
-	Port     uint16   `toml:"port"` // default: 443
-	Hostname string   `toml:"hostname"`
-	Path     string   `toml:"path"` // default: /dns-query
-	Google   bool     `toml:"google"`
-	Cookie   bool     `toml:"cookie"`
-	Weight   int32    `toml:"weight"` // default: 1
+	Host      []string `toml:"host"`
+	Port      uint16   `toml:"port"` // default: 443
+	Hostname  string   `toml:"hostname"`
+	Path      string   `toml:"path"` // default: /dns-query
+	Google    bool     `toml:"google"`
+	Cookie    bool     `toml:"cookie"`
+	ODoHProxy string   `toml:"odoh_proxy"`
+	Bootstrap bool     `toml:"bootstrap"`
+	Weight    int32    `toml:"weight"` // default: 1
+	Tag       string   `toml:"tag"`
+	// StampBootstrap are DNS servers recommended by DNS stamp to resolve Host
+	StampBootstrap []typeTraditional `toml:"-"`
 	typeCustomSpecified
+	HTTPSettings
+	TLSSettings
 	DNSSettings
 }
 
 type typeUpstreamTLS struct {
-	Host     []string `toml:"host"`
-	Port     uint16   `toml:"port"` // default: 853
-	Hostname string   `toml:"hostname"`
-	Weight   int32    `toml:"weight"` // default: 1
+	Host      []string `toml:"host"`
+	Port      uint16   `toml:"port"` // default: 853
+	Hostname  string   `toml:"hostname"`
+	Bootstrap bool     `toml:"bootstrap"`
+	Weight    int32    `toml:"weight"` // default: 1
+	Tag       string   `toml:"tag"`
+	// StampBootstrap are DNS servers recommended by DNS stamp to resolve Host
+	StampBootstrap []typeTraditional `toml:"-"`
+	typeCustomSpecified
+	TLSSettings
+	DNSSettings
+}
+
+type typeDNSCrypt struct {
+	Stamp  string `toml:"stamp"`
+	Weight int32  `toml:"weight"` // default: 1
+	Tag    string `toml:"tag"`
 	typeCustomSpecified
 	DNSSettings
 }
@@ -57,18 +202,95 @@ type typeTraditional struct {
 	Port      uint16   `toml:"port"` // default: 53
 	Bootstrap bool     `toml:"bootstrap"`
 	Weight    int32    `toml:"weight"` // default: 1
+	Tag       string   `toml:"tag"`
 	typeCustomSpecified
 	DNSSettings
 }
 
+type typeListener struct {
+	Allow CIDRList `toml:"allow"`
+	Deny  CIDRList `toml:"deny"`
+}
+
+type typeClientGroup struct {
+	Name          string   `toml:"name"`
+	CIDR          CIDRList `toml:"cidr"`
+	UpstreamTag   string   `toml:"upstream_tag"`
+	CustomECS     []net.IP `toml:"custom_ecs"`
+	NoECS         bool     `toml:"no_ecs"`
+	NoCache       bool     `toml:"no_cache"`
+	CacheNoAnswer *uint32  `toml:"cache_no_answer"`
+	DisableAAAA   *bool    `toml:"disable_aaaa"`   // default: disable_aaaa of [config]
+	PreferIPv4    *bool    `toml:"prefer_ipv4"`    // default: prefer_ipv4 of [config]
+	DNS64         *bool    `toml:"dns64"`          // default: dns64 of [config]
+	DNS64Prefix   *CIDR    `toml:"dns64_prefix"`   // default: dns64_prefix of [config]
+	SVCBPolicy    *string  `toml:"svcb_policy"`    // default: svcb_policy of [config]
+	SVCBStripECH  *bool    `toml:"svcb_strip_ech"` // default: svcb_strip_ech of [config]
+}
+
+type typeRewrite struct {
+	CNAME string   `toml:"cname"`
+	Alias bool     `toml:"alias"`
+	IPv4  []net.IP `toml:"ipv4"`
+	IPv6  []net.IP `toml:"ipv6"`
+	typeCustomSpecified
+}
+
+type typeZone struct {
+	Name string `toml:"name"`
+	File string `toml:"file"`
+}
+
 // Config described user configuration
 type Config struct {
-	ConfigFile  string                         `toml:"-"`
-	Config      typeGeneralConfig              `toml:"config"`
-	HTTPS       []typeUpstreamHTTPS            `toml:"https"`
-	TLS         []typeUpstreamTLS              `toml:"tls"`
-	Traditional []typeTraditional              `toml:"traditional"`
-	Hosts       map[string]map[string][]string `toml:"hosts"`
+	ConfigFile  string                  `toml:"-"`
+	Config      typeGeneralConfig       `toml:"config"`
+	HTTPS       []typeUpstreamHTTPS     `toml:"https"`
+	TLS         []typeUpstreamTLS       `toml:"tls"`
+	Traditional []typeTraditional       `toml:"traditional"`
+	DNSCrypt    []typeDNSCrypt          `toml:"dnscrypt"`
+	ClientGroup []typeClientGroup       `toml:"client_group"`
+	Listener    map[string]typeListener `toml:"listener"`
+	Hosts       map[string]typeHosts    `toml:"hosts"`
+	Rewrite     []typeRewrite           `toml:"rewrite"`
+	Zone        []typeZone              `toml:"zone"`
+}
+
+// Path returns file path relative to the directory of configuration file
+func (config *Config) Path(file string) string {
+	if filepath.IsLocal(file) {
+		return filepath.Join(filepath.Dir(config.ConfigFile), file)
+	}
+	return file
+}
+
+// checkDNS64Prefix checks prefix length of DNS64 prefix, which can only be 32, 40, 48, 56, 64 or 96 (RFC 6052)
+func checkDNS64Prefix(prefix *CIDR) error {
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 {
+		return fmt.Errorf("DNS64 prefix should be an IPv6 network: %s", prefix.String())
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("invalid DNS64 prefix length: %s", prefix.String())
+	}
+	if prefix.IP.To16()[8] != 0 {
+		return fmt.Errorf("bits 64 to 71 of DNS64 prefix should be zero: %s", prefix.String())
+	}
+	return nil
+}
+
+// checkSVCBPolicy checks svcb_policy, which can only be keep, drop, strip_hints or rewrite_hints
+func checkSVCBPolicy(policy *string) error {
+	if policy == nil {
+		return nil
+	}
+	switch *policy {
+	case SVCBPolicyKeep, SVCBPolicyDrop, SVCBPolicyStripHints, SVCBPolicyRewriteHints:
+		return nil
+	}
+	return fmt.Errorf("no such svcb policy: %s", *policy)
 }
 
 // LoadConfig from configuration file
@@ -88,10 +310,145 @@ func LoadConfig(configPath string) (config *Config, err error) {
 		*config.Config.Timeout = 5
 	}
 
+	if config.Config.BootstrapRefresh == nil {
+		config.Config.BootstrapRefresh = new(uint)
+		*config.Config.BootstrapRefresh = 3600
+	}
+
+	if config.Config.HostsTTL == nil {
+		config.Config.HostsTTL = new(uint32)
+		*config.Config.HostsTTL = 60
+	}
+
+	if config.Config.DNS64Prefix == nil {
+		config.Config.DNS64Prefix = new(CIDR)
+		config.Config.DNS64Prefix.UnmarshalText([]byte("64:ff9b::/96"))
+	}
+	if err = checkDNS64Prefix(config.Config.DNS64Prefix); err != nil {
+		return
+	}
+
+	switch config.Config.DenyAction {
+	case "":
+		config.Config.DenyAction = DenyActionRefuse
+	case DenyActionRefuse, DenyActionDrop:
+	default:
+		err = fmt.Errorf("no such deny action: %s", config.Config.DenyAction)
+		return
+	}
+
+	if config.Config.SVCBPolicy == "" {
+		config.Config.SVCBPolicy = SVCBPolicyKeep
+	}
+	if err = checkSVCBPolicy(&config.Config.SVCBPolicy); err != nil {
+		return
+	}
+
+	if config.Config.RateLimit > 0 {
+		if config.Config.RateLimitBurst == 0 {
+			config.Config.RateLimitBurst = config.Config.RateLimit
+		}
+		if config.Config.RateLimitSlip == nil {
+			config.Config.RateLimitSlip = new(uint)
+			*config.Config.RateLimitSlip = 2
+		}
+		if config.Config.RateLimitIPv4Prefix <= 0 || config.Config.RateLimitIPv4Prefix > 32 {
+			config.Config.RateLimitIPv4Prefix = 32
+		}
+		if config.Config.RateLimitIPv6Prefix <= 0 || config.Config.RateLimitIPv6Prefix > 128 {
+			config.Config.RateLimitIPv6Prefix = 56
+		}
+	}
+
+	for address := range config.Listener {
+		found := false
+		for _, listen := range config.Config.Listen {
+			if listen == address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			err = fmt.Errorf("listener %s is not in listen addresses", address)
+			return
+		}
+	}
+
 	if config.Config.RoundRobin == "" {
 		config.Config.RoundRobin = SelectorClock
 	}
 
+	groupNames := make(map[string]bool, len(config.ClientGroup))
+	for _, group := range config.ClientGroup {
+		if group.Name == "" {
+			err = errors.New("client group without name")
+			return
+		}
+		if groupNames[group.Name] {
+			err = fmt.Errorf("duplicated client group: %s", group.Name)
+			return
+		}
+		groupNames[group.Name] = true
+		if group.DNS64Prefix != nil {
+			if err = checkDNS64Prefix(group.DNS64Prefix); err != nil {
+				return
+			}
+		}
+		if err = checkSVCBPolicy(group.SVCBPolicy); err != nil {
+			return
+		}
+	}
+
+	for _, zone := range config.Zone {
+		if zone.Name == "" || zone.File == "" {
+			err = errors.New("zone without name or file")
+			return
+		}
+	}
+
+	for _, rewrite := range config.Rewrite {
+		if !rewrite.CustomSpecified() {
+			err = errors.New("rewrite rule without condition")
+			return
+		}
+		if rewrite.CNAME == "" && len(rewrite.IPv4)+len(rewrite.IPv6) == 0 {
+			err = errors.New("rewrite rule without cname, ipv4 or ipv6")
+			return
+		}
+		if rewrite.Alias && rewrite.CNAME == "" {
+			err = errors.New("alias of rewrite rule requires cname")
+			return
+		}
+		if err = checkSVCBPolicy(rewrite.SVCBPolicy); err != nil {
+			return
+		}
+		for _, ip := range rewrite.IPv4 {
+			if ip.To4() == nil {
+				err = fmt.Errorf("not an IPv4 address: %s", ip.String())
+				return
+			}
+		}
+		for _, ip := range rewrite.IPv6 {
+			if ip.To4() != nil {
+				err = fmt.Errorf("not an IPv6 address: %s", ip.String())
+				return
+			}
+		}
+	}
+
+	for _, hosts := range config.Hosts {
+		if err = checkSVCBPolicy(hosts.SVCBPolicy); err != nil {
+			return
+		}
+	}
+
+	for _, upstream := range config.Config.Upstreams {
+		if err = config.addUpstream(upstream); err != nil {
+			err = fmt.Errorf("invalid upstream %s: %s", upstream, err.Error())
+			return
+		}
+	}
+
 	for index := range config.HTTPS {
 		https := &config.HTTPS[index]
 		if https.Port == 0 {
@@ -103,6 +460,18 @@ func LoadConfig(configPath string) (config *Config, err error) {
 		if https.Weight < 1 {
 			https.Weight = 1
 		}
+		if err = checkSVCBPolicy(https.SVCBPolicy); err != nil {
+			return
+		}
+		if https.ODoHProxy != "" && https.Google {
+			err = fmt.Errorf("odoh_proxy can not be used with google: %v", https.Host)
+			return
+		}
+		// headers and basic authentication would identify the client to the proxy
+		if https.ODoHProxy != "" && (len(https.Headers) > 0 || https.Username != "" || https.Password != "") {
+			err = fmt.Errorf("odoh_proxy can not be used with headers, username or password: %v", https.Host)
+			return
+		}
 	}
 
 	for index := range config.TLS {
@@ -113,6 +482,27 @@ func LoadConfig(configPath string) (config *Config, err error) {
 		if tls.Weight < 1 {
 			tls.Weight = 1
 		}
+		if err = checkSVCBPolicy(tls.SVCBPolicy); err != nil {
+			return
+		}
+	}
+
+	for index := range config.DNSCrypt {
+		dnsCrypt := &config.DNSCrypt[index]
+		var stamp *Stamp
+		if stamp, err = ParseStamp(dnsCrypt.Stamp); err != nil {
+			return
+		}
+		if stamp.Protocol != StampProtocolDNSCrypt {
+			err = fmt.Errorf("not a DNSCrypt stamp: %s", dnsCrypt.Stamp)
+			return
+		}
+		if dnsCrypt.Weight < 1 {
+			dnsCrypt.Weight = 1
+		}
+		if err = checkSVCBPolicy(dnsCrypt.SVCBPolicy); err != nil {
+			return
+		}
 	}
 
 	for index := range config.Traditional {
@@ -123,6 +513,9 @@ func LoadConfig(configPath string) (config *Config, err error) {
 		if traditional.Weight < 1 {
 			traditional.Weight = 1
 		}
+		if err = checkSVCBPolicy(traditional.SVCBPolicy); err != nil {
+			return
+		}
 	}
 
 	return
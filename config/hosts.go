@@ -0,0 +1,66 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+type typeHostsOptions struct {
+	TTL *uint32 `toml:"ttl"` // default: hosts_ttl
+	typeCustomSpecified
+}
+
+type typeHosts struct {
+	// Records are keyed by upper case record types, such as A, AAAA, TXT
+	Records map[string][]string
+	typeHostsOptions
+}
+
+// UnmarshalTOML splits upper case record types and lower case options of a hosts table
+func (hosts *typeHosts) UnmarshalTOML(data interface{}) error {
+	table, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("hosts should be a table, got %T", data)
+	}
+
+	hosts.Records = make(map[string][]string)
+	options := make(map[string]interface{})
+
+	for key, value := range table {
+		if strings.ToUpper(key) != key {
+			options[key] = value
+			continue
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("records of %s should be an array of strings", key)
+		}
+		records := make([]string, len(list))
+		for index, item := range list {
+			if records[index], ok = item.(string); !ok {
+				return fmt.Errorf("records of %s should be an array of strings", key)
+			}
+		}
+		hosts.Records[key] = records
+	}
+
+	if len(options) == 0 {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(options); err != nil {
+		return err
+	}
+	meta, err := toml.Decode(buffer.String(), &hosts.typeHostsOptions)
+	if err != nil {
+		return err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("unknown hosts option: %s", undecoded[0].String())
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StampProtocol is the protocol of DNS server described by a DNS stamp
+type StampProtocol byte
+
+// protocols of DNS stamps
+const (
+	StampProtocolPlain         StampProtocol = 0x00
+	StampProtocolDNSCrypt      StampProtocol = 0x01
+	StampProtocolDoH           StampProtocol = 0x02
+	StampProtocolDoT           StampProtocol = 0x03
+	StampProtocolDoQ           StampProtocol = 0x04
+	StampProtocolODoHTarget    StampProtocol = 0x05
+	StampProtocolDNSCryptRelay StampProtocol = 0x81
+	StampProtocolODoHRelay     StampProtocol = 0x85
+)
+
+func (protocol StampProtocol) String() string {
+	switch protocol {
+	case StampProtocolPlain:
+		return "plain DNS"
+	case StampProtocolDNSCrypt:
+		return "DNSCrypt"
+	case StampProtocolDoH:
+		return "DNS over HTTPS"
+	case StampProtocolDoT:
+		return "DNS over TLS"
+	case StampProtocolDoQ:
+		return "DNS over QUIC"
+	case StampProtocolODoHTarget:
+		return "oblivious DoH target"
+	case StampProtocolDNSCryptRelay:
+		return "DNSCrypt relay"
+	case StampProtocolODoHRelay:
+		return "oblivious DoH relay"
+	}
+	return fmt.Sprintf("protocol 0x%02x", byte(protocol))
+}
+
+// Stamp describes a DNS server, see https://dnscrypt.info/stamps-specifications
+type Stamp struct {
+	Protocol StampProtocol
+	// Props are informal properties: DNSSEC, no logs and no filter
+	Props uint64
+	// Address is ip address of the server, with an optional port, e.g. 1.1.1.1, [2606:4700::1111]:853
+	Address string
+	// Hashes are SHA-256 hashes of to-be-signed part of certificates in the chain of DoH and DoT servers
+	Hashes [][]byte
+	// Hostname of DoH and DoT servers, with an optional port
+	Hostname string
+	// Path of DoH servers
+	Path string
+	// ProviderName of DNSCrypt servers, e.g. 2.dnscrypt-cert.example.com
+	ProviderName string
+	// PublicKey of DNSCrypt servers, which signs certificates
+	PublicKey []byte
+	// Bootstrap are ip addresses of resolvers recommended to resolve Hostname
+	Bootstrap []string
+}
+
+// stampReader reads fields of DNS stamps
+type stampReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *stampReader) read(n int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if len(reader.data) < n {
+		reader.err = errors.New("stamp is too short")
+		return nil
+	}
+	field := reader.data[:n]
+	reader.data = reader.data[n:]
+	return field
+}
+
+// lp reads a length-prefixed field
+func (reader *stampReader) lp() []byte {
+	length := reader.read(1)
+	if length == nil {
+		return nil
+	}
+	return reader.read(int(length[0]))
+}
+
+// vlp reads a variable length list of length-prefixed fields, 0x80 of the length means there are more fields
+func (reader *stampReader) vlp() [][]byte {
+	var list [][]byte
+	for reader.err == nil {
+		length := reader.read(1)
+		if length == nil {
+			break
+		}
+		field := reader.read(int(length[0] & 0x7f))
+		if len(field) > 0 {
+			list = append(list, field)
+		}
+		if length[0]&0x80 == 0 {
+			break
+		}
+	}
+	return list
+}
+
+// ParseStamp parses sdns:// DNS stamp
+func ParseStamp(str string) (*Stamp, error) {
+	if !strings.HasPrefix(str, "sdns://") {
+		return nil, errors.New("DNS stamp should start with sdns://")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(str[len("sdns://"):], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS stamp: %s", err.Error())
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty DNS stamp")
+	}
+
+	stamp := &Stamp{Protocol: StampProtocol(data[0])}
+	reader := &stampReader{data: data[1:]}
+
+	switch stamp.Protocol {
+	case StampProtocolPlain, StampProtocolDNSCrypt, StampProtocolDoH, StampProtocolDoT, StampProtocolDoQ,
+		StampProtocolODoHTarget, StampProtocolODoHRelay:
+		if props := reader.read(8); props != nil {
+			stamp.Props = binary.LittleEndian.Uint64(props)
+		}
+	}
+
+	switch stamp.Protocol {
+	case StampProtocolPlain:
+		stamp.Address = string(reader.lp())
+	case StampProtocolDNSCrypt:
+		stamp.Address = string(reader.lp())
+		stamp.PublicKey = reader.lp()
+		stamp.ProviderName = string(reader.lp())
+	case StampProtocolDoH, StampProtocolDoT, StampProtocolDoQ:
+		stamp.Address = string(reader.lp())
+		stamp.Hashes = reader.vlp()
+		stamp.Hostname = string(reader.lp())
+		if stamp.Protocol == StampProtocolDoH {
+			stamp.Path = string(reader.lp())
+		}
+		if len(reader.data) > 0 {
+			for _, bootstrap := range reader.vlp() {
+				stamp.Bootstrap = append(stamp.Bootstrap, string(bootstrap))
+			}
+		}
+	case StampProtocolODoHTarget:
+		stamp.Hostname = string(reader.lp())
+		stamp.Path = string(reader.lp())
+	case StampProtocolDNSCryptRelay:
+		stamp.Address = string(reader.lp())
+	case StampProtocolODoHRelay:
+		stamp.Address = string(reader.lp())
+		stamp.Hashes = reader.vlp()
+		stamp.Hostname = string(reader.lp())
+		stamp.Path = string(reader.lp())
+	default:
+		return nil, fmt.Errorf("unknown DNS stamp protocol: 0x%02x", byte(stamp.Protocol))
+	}
+
+	if reader.err != nil {
+		return nil, fmt.Errorf("invalid DNS stamp: %s", reader.err.Error())
+	}
+	return stamp, nil
+}
@@ -0,0 +1,353 @@
+package config
+
+import (
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// addUpstream adds upstream described by URL or DNS stamp, such as
+// udp://9.9.9.9, tls://1.1.1.1?hostname=cloudflare-dns.com, https://dns.google/dns-query, sdns://...
+//
+// Options of the upstream are specified with query parameters, named as keys of [[traditional]], [[tls]], [[https]] or [[dnscrypt]],
+// list options are specified by repeating the parameter, e.g. ?suffix=example.com&suffix=example.org,
+// and table options with dot, e.g. ?headers.X-Tenant=abc
+func (config *Config) addUpstream(upstream string) error {
+	if strings.HasPrefix(upstream, "sdns://") {
+		return config.addUpstreamStamp(upstream)
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	if u.Hostname() == "" {
+		return errors.New("no host")
+	}
+	var port uint16
+	if u.Port() != "" {
+		p, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port: %s", u.Port())
+		}
+		port = uint16(p)
+	}
+	query := u.Query()
+
+	switch u.Scheme {
+	case "udp", "dns":
+		traditional := typeTraditional{}
+		if err = decodeQuery(query, &traditional); err != nil {
+			return err
+		}
+		traditional.Host = append([]string{u.Hostname()}, traditional.Host...)
+		if port != 0 {
+			traditional.Port = port
+		}
+		config.Traditional = append(config.Traditional, traditional)
+	case "tls":
+		tls := typeUpstreamTLS{}
+		if err = decodeQuery(query, &tls); err != nil {
+			return err
+		}
+		tls.Host = append([]string{u.Hostname()}, tls.Host...)
+		if port != 0 {
+			tls.Port = port
+		}
+		config.TLS = append(config.TLS, tls)
+	case "https", "https+google":
+		https := typeUpstreamHTTPS{}
+		if err = decodeQuery(query, &https); err != nil {
+			return err
+		}
+		https.Host = append([]string{u.Hostname()}, https.Host...)
+		if port != 0 {
+			https.Port = port
+		}
+		if u.Path != "" {
+			https.Path = u.Path
+		}
+		if u.Scheme == "https+google" {
+			https.Google = true
+		}
+		if u.User != nil {
+			https.Username = u.User.Username()
+			https.Password, _ = u.User.Password()
+		}
+		config.HTTPS = append(config.HTTPS, https)
+	default:
+		return fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	return nil
+}
+
+// addUpstreamStamp adds upstream described by DNS stamp, options can be appended as query parameters
+func (config *Config) addUpstreamStamp(upstream string) error {
+	rawQuery := ""
+	if index := strings.IndexByte(upstream, '?'); index >= 0 {
+		upstream, rawQuery = upstream[:index], upstream[index+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return err
+	}
+	stamp, err := ParseStamp(upstream)
+	if err != nil {
+		return err
+	}
+
+	switch stamp.Protocol {
+	case StampProtocolPlain:
+		traditional := typeTraditional{}
+		if err = decodeQuery(query, &traditional); err != nil {
+			return err
+		}
+		host, port, err := splitAddress(stamp.Address)
+		if err != nil {
+			return err
+		}
+		traditional.Host = append([]string{host}, traditional.Host...)
+		if port != 0 {
+			traditional.Port = port
+		}
+		config.Traditional = append(config.Traditional, traditional)
+	case StampProtocolDoT:
+		tls := typeUpstreamTLS{}
+		if err = decodeQuery(query, &tls); err != nil {
+			return err
+		}
+		var host string
+		if host, tls.Hostname, tls.Port, err = stampHost(stamp); err != nil {
+			return err
+		}
+		tls.Host = append([]string{host}, tls.Host...)
+		tls.CertTBSHash = append(tls.CertTBSHash, stampHashes(stamp)...)
+		if tls.StampBootstrap, err = stampBootstrap(stamp); err != nil {
+			return err
+		}
+		config.TLS = append(config.TLS, tls)
+	case StampProtocolDoH:
+		https := typeUpstreamHTTPS{}
+		if err = decodeQuery(query, &https); err != nil {
+			return err
+		}
+		var host string
+		if host, https.Hostname, https.Port, err = stampHost(stamp); err != nil {
+			return err
+		}
+		https.Host = append([]string{host}, https.Host...)
+		https.Path = stamp.Path
+		https.CertTBSHash = append(https.CertTBSHash, stampHashes(stamp)...)
+		if https.StampBootstrap, err = stampBootstrap(stamp); err != nil {
+			return err
+		}
+		config.HTTPS = append(config.HTTPS, https)
+	case StampProtocolODoHTarget:
+		https := typeUpstreamHTTPS{}
+		if err = decodeQuery(query, &https); err != nil {
+			return err
+		}
+		if https.ODoHProxy == "" {
+			return errors.New("oblivious DoH target stamp requires odoh_proxy option")
+		}
+		host, port, err := splitAddress(stamp.Hostname)
+		if err != nil {
+			return err
+		}
+		https.Host = append([]string{host}, https.Host...)
+		if port != 0 {
+			https.Port = port
+		}
+		https.Path = stamp.Path
+		config.HTTPS = append(config.HTTPS, https)
+	case StampProtocolDNSCrypt:
+		dnsCrypt := typeDNSCrypt{}
+		if err = decodeQuery(query, &dnsCrypt); err != nil {
+			return err
+		}
+		dnsCrypt.Stamp = upstream
+		config.DNSCrypt = append(config.DNSCrypt, dnsCrypt)
+	default:
+		return fmt.Errorf("unsupported DNS stamp protocol: %s", stamp.Protocol.String())
+	}
+	return nil
+}
+
+// stampHost returns host, hostname for ip address and port of DoH and DoT stamp
+func stampHost(stamp *Stamp) (string, string, uint16, error) {
+	hostname, hostnamePort, err := splitAddress(stamp.Hostname)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if stamp.Address == "" {
+		if hostname == "" {
+			return "", "", 0, errors.New("no address or hostname in DNS stamp")
+		}
+		return hostname, "", hostnamePort, nil
+	}
+	host, port, err := splitAddress(stamp.Address)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if port == 0 {
+		port = hostnamePort
+	}
+	return host, hostname, port, nil
+}
+
+// stampHashes returns hex encoded certificate hashes of stamp
+func stampHashes(stamp *Stamp) []string {
+	hashes := make([]string, len(stamp.Hashes))
+	for index, hash := range stamp.Hashes {
+		hashes[index] = hex.EncodeToString(hash)
+	}
+	return hashes
+}
+
+// stampBootstrap returns DNS servers recommended by stamp to resolve its hostname, which should be ip addresses
+func stampBootstrap(stamp *Stamp) ([]typeTraditional, error) {
+	servers := make([]typeTraditional, 0, len(stamp.Bootstrap))
+	for _, address := range stamp.Bootstrap {
+		host, port, err := splitAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("bootstrap of DNS stamp should be an ip address: %s", address)
+		}
+		if port == 0 {
+			port = 53
+		}
+		servers = append(servers, typeTraditional{Host: []string{host}, Port: port})
+	}
+	return servers, nil
+}
+
+// splitAddress splits host and optional port of address, such as 1.1.1.1, [::1], 1.1.1.1:53, [::1]:53 or example.com:443
+func splitAddress(address string) (string, uint16, error) {
+	if address == "" {
+		return "", 0, nil
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		// no port
+		return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), 0, nil
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port: %s", portString)
+	}
+	return host, uint16(port), nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// decodeQuery decodes query parameters into upstream config v, keys of query are TOML keys of v
+func decodeQuery(query url.Values, v interface{}) error {
+	fields := make(map[string]reflect.Type)
+	tomlFields(reflect.TypeOf(v).Elem(), fields)
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var doc strings.Builder
+	for _, key := range keys {
+		values := query[key]
+		name, subKey := key, ""
+		if dot := strings.IndexByte(key, '.'); dot >= 0 {
+			name, subKey = key[:dot], key[dot+1:]
+		}
+		t, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown option: %s", name)
+		}
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		switch {
+		case t.Kind() == reflect.Map:
+			if subKey == "" {
+				return fmt.Errorf("option %s should be specified as %s.KEY", name, name)
+			}
+			value, err := tomlValue(t.Elem(), values[len(values)-1])
+			if err != nil {
+				return fmt.Errorf("invalid option %s: %s", key, err.Error())
+			}
+			fmt.Fprintf(&doc, "%s.%s = %s\n", name, strconv.Quote(subKey), value)
+		case subKey != "":
+			return fmt.Errorf("unknown option: %s", key)
+		case t.Kind() == reflect.Slice && !reflect.PtrTo(t).Implements(textUnmarshalerType):
+			list := make([]string, len(values))
+			for index, value := range values {
+				var err error
+				if list[index], err = tomlValue(t.Elem(), value); err != nil {
+					return fmt.Errorf("invalid option %s: %s", key, err.Error())
+				}
+			}
+			fmt.Fprintf(&doc, "%s = [%s]\n", name, strings.Join(list, ", "))
+		default:
+			value, err := tomlValue(t, values[len(values)-1])
+			if err != nil {
+				return fmt.Errorf("invalid option %s: %s", key, err.Error())
+			}
+			fmt.Fprintf(&doc, "%s = %s\n", name, value)
+		}
+	}
+
+	_, err := toml.Decode(doc.String(), v)
+	return err
+}
+
+// tomlFields collects types of fields of struct type t by their TOML keys, including fields of embedded structs
+func tomlFields(t reflect.Type, fields map[string]reflect.Type) {
+	for index := 0; index < t.NumField(); index++ {
+		field := t.Field(index)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			tomlFields(field.Type, fields)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = field.Type
+		}
+	}
+}
+
+// tomlValue converts value of query parameter to TOML value of type t, empty value of boolean is true
+func tomlValue(t reflect.Type, value string) (string, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		if value == "" {
+			return "true", nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(b), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(value, 10, t.Bits()); err != nil {
+			return "", err
+		}
+		return value, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(value, 10, t.Bits()); err != nil {
+			return "", err
+		}
+		return value, nil
+	}
+	return strconv.Quote(value), nil
+}